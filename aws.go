@@ -0,0 +1,190 @@
+package httplib
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// awsSigner signs requests with AWS Signature Version 4.
+type awsSigner struct {
+    accessKey string
+    secretKey string
+    region    string
+    service   string
+    now       func() time.Time
+}
+
+// unsignedPayload stands in for the hash of a body that can't be read
+// ahead of sending it.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// AWSV4Sign signs the request with AWS Signature Version 4, for S3 and
+// other services that use it, setting the Authorization and X-Amz-Date
+// headers just before it is sent. It is signed again for each retry or
+// redirect. The Host, Content-Type and any X-Amz-* headers are signed.
+//
+// The body is signed by its hash, except for one from an io.Reader or with
+// files, which can't be read ahead and is sent as UNSIGNED-PAYLOAD, which S3
+// accepts. For S3 the hash is also sent as X-Amz-Content-Sha256, as it
+// requires.
+func (b *HttpRequestBuilder) AWSV4Sign(accessKey, secretKey, region, service string) *HttpRequestBuilder {
+    b.awsSigner = &awsSigner{
+        accessKey: accessKey,
+        secretKey: secretKey,
+        region:    region,
+        service:   service,
+        now:       time.Now,
+    }
+    return b
+}
+
+// signAWS signs the request, about to be sent to u.
+func (b *HttpRequestBuilder) signAWS(u *url.URL) error {
+    payloadHash, err := b.payloadHash()
+    if err != nil {
+        return err
+    }
+    b.awsSigner.sign(b.req, u, payloadHash)
+    return nil
+}
+
+// payloadHash returns the hex encoded SHA-256 of the request body.
+func (b *HttpRequestBuilder) payloadHash() (string, error) {
+    h := sha256.New()
+    switch {
+    case b.bodyFile != "":
+        f, err := os.Open(b.bodyFile)
+        if err != nil {
+            return "", err
+        }
+        defer f.Close()
+        if _, err := io.Copy(h, f); err != nil {
+            return "", err
+        }
+    case b.gzBody != nil:
+        h.Write(b.gzBody)
+    case b.body != nil:
+        h.Write(b.body)
+    case b.bodyReader != nil || len(b.files) > 0:
+        return unsignedPayload, nil
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *awsSigner) sign(req *http.Request, u *url.URL, payloadHash string) {
+    t := s.now().UTC()
+    amzDate := t.Format("20060102T150405Z")
+    date := amzDate[:8]
+    req.Header.Set("X-Amz-Date", amzDate)
+    if s.service == "s3" {
+        req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+    }
+
+    headers := map[string]string{"host": u.Host}
+    if u.Port() == "80" && u.Scheme == "http" || u.Port() == "443" && u.Scheme == "https" {
+        headers["host"] = u.Hostname()
+    }
+    for key, values := range req.Header {
+        key = strings.ToLower(key)
+        if key == "content-type" || strings.HasPrefix(key, "x-amz-") {
+            trimmed := make([]string, len(values))
+            for i, v := range values {
+                trimmed[i] = strings.Join(strings.Fields(v), " ")
+            }
+            headers[key] = strings.Join(trimmed, ",")
+        }
+    }
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        awsPath(u, s.service),
+        awsQuery(u),
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+    scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+    requestHash := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+    key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+    key = hmacSHA256(key, s.region)
+    key = hmacSHA256(key, s.service)
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes every byte of s except the unreserved
+// characters, as signing requires.
+func awsEscape(s string) string {
+    var buf strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '_' || c == '.' || c == '~' {
+            buf.WriteByte(c)
+        } else {
+            fmt.Fprintf(&buf, "%%%02X", c)
+        }
+    }
+    return buf.String()
+}
+
+// awsPath returns the canonical path of u for service. Each segment is
+// encoded once for S3, and twice for other services, as they expect.
+func awsPath(u *url.URL, service string) string {
+    segments := strings.Split(u.Path, "/")
+    for i, segment := range segments {
+        segment = awsEscape(segment)
+        if service != "s3" {
+            segment = awsEscape(segment)
+        }
+        segments[i] = segment
+    }
+    path := strings.Join(segments, "/")
+    if !strings.HasPrefix(path, "/") {
+        path = "/" + path
+    }
+    return path
+}
+
+// awsQuery returns the canonical query string of u, sorted by key and then
+// value.
+func awsQuery(u *url.URL) string {
+    var pairs []string
+    for key, values := range u.Query() {
+        for _, value := range values {
+            pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+        }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
@@ -0,0 +1,74 @@
+package httplib
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestAWSV4Sign(t *testing.T) {
+    var got http.Header
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r.Header
+    }))
+    defer ts.Close()
+    now := func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+    sign := func(b *HttpRequestBuilder, service string) *HttpRequestBuilder {
+        b.ResolveOverride("example.amazonaws.com", ts.Listener.Addr().String()).
+            AWSV4Sign("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", service)
+        b.awsSigner.now = now
+        return b
+    }
+
+    // from the AWS Signature Version 4 test suite
+    for _, c := range []struct {
+        b         *HttpRequestBuilder
+        signature string
+    }{
+        {Get("http://example.amazonaws.com/"), "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+        {Post("http://example.amazonaws.com/"), "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+        {Get("http://example.amazonaws.com/?Param2=value2&Param1=value1"), "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+    } {
+        if _, err := sign(c.b, "service").AsString(); err != nil {
+            t.Fatal(err)
+        }
+        want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+            "SignedHeaders=host;x-amz-date, Signature=" + c.signature
+        if auth := got.Get("Authorization"); auth != want {
+            t.Errorf("%s %s: expected\n%s\ngot\n%s", c.b.req.Method, c.b.url, want, auth)
+        }
+        if got.Get("X-Amz-Date") != "20150830T123600Z" {
+            t.Errorf("unexpected X-Amz-Date %q", got.Get("X-Amz-Date"))
+        }
+    }
+
+    if _, err := sign(Put("http://example.amazonaws.com/bucket/a%20b.txt"), "s3").Body("hello").AsString(); err != nil {
+        t.Fatal(err)
+    }
+    if got.Get("X-Amz-Content-Sha256") != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+        t.Fatalf("unexpected X-Amz-Content-Sha256 %q", got.Get("X-Amz-Content-Sha256"))
+    }
+    if !strings.Contains(got.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date,") {
+        t.Fatalf("expected the content hash to be signed, got %q", got.Get("Authorization"))
+    }
+    if _, err := sign(Put("http://example.amazonaws.com/bucket/key"), "s3").Body(strings.NewReader("hello")).AsString(); err != nil {
+        t.Fatal(err)
+    }
+    if got.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+        t.Fatalf("expected an unsigned payload for a reader, got %q", got.Get("X-Amz-Content-Sha256"))
+    }
+}
+
+func TestAWSPath(t *testing.T) {
+    // from the AWS documentation on creating a canonical request
+    u := &url.URL{Path: "/documents and settings/"}
+    if path := awsPath(u, "s3"); path != "/documents%20and%20settings/" {
+        t.Fatalf("expected the path encoded once for S3, got %s", path)
+    }
+    if path := awsPath(u, "iam"); path != "/documents%2520and%2520settings/" {
+        t.Fatalf("expected the path encoded twice for other services, got %s", path)
+    }
+}
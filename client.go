@@ -0,0 +1,345 @@
+package httplib
+
+import (
+    "bytes"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ErrClientClosed is returned for requests made through a Client after it
+// has been closed.
+var ErrClientClosed = errors.New("httplib: client closed")
+
+// Client reuses connections across the requests built from it. Once a
+// response body has been read to the end by one of the As* methods, its
+// connection is kept open for the next request to the same host. Requests
+// built with the package level Get, Post and so on always use a connection
+// of their own.
+//
+// A Client is safe for concurrent use, and its zero value is ready to use.
+type Client struct {
+    // traffic comes first so that its counters are 64-bit aligned, as
+    // atomic operations need on 32-bit platforms
+    traffic traffic
+
+    // Dialer makes the connections of the Client, unless a request sets its
+    // own. If nil, connections are dialed with net.Dial.
+    Dialer Dialer
+    // WriteBufferSize, if set, is the size of the buffer each request and its
+    // body are written to the connection through, so that a body read in
+    // small pieces goes out in fewer, larger writes. Otherwise net/http
+    // buffers 4KB.
+    WriteBufferSize int
+    // ReadBufferSize, if set, is the size of the buffer responses are read
+    // from the connection through, so that a large body read in small
+    // pieces, as by a decoder, comes in fewer, larger reads. It defaults to
+    // 4KB.
+    ReadBufferSize int
+    // Transport, if set, sends the requests of the Client instead of its
+    // connections, unless a request sets its own. See
+    // HttpRequestBuilder.Transport.
+    Transport http.RoundTripper
+    // TLSSessionCache holds the TLS sessions of the Client, by host and TLS
+    // settings, so that new connections to a host it has connected to before
+    // with the same settings resume a session rather than make a full
+    // handshake. A session made with one TLSConfig, and so perhaps one client
+    // certificate, isn't resumed with another. If nil, the Client keeps an
+    // LRU cache of 64 sessions. It isn't used for requests whose TLSConfig
+    // has a ClientSessionCache of its own.
+    TLSSessionCache tls.ClientSessionCache
+
+    mu sync.Mutex
+    // idle holds the connections open for reuse, by pool key
+    idle map[string][]*persistConn
+    // conns holds every open connection, idle or in use
+    conns    map[*persistConn]bool
+    closed   bool
+    sessions tls.ClientSessionCache
+}
+
+// traffic counts the bytes sent and received over connections.
+type traffic struct {
+    sent, received int64
+}
+
+// countingConn counts the bytes written to and read from a connection.
+type countingConn struct {
+    net.Conn
+    traffic *traffic
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    atomic.AddInt64(&c.traffic.received, int64(n))
+    return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    atomic.AddInt64(&c.traffic.sent, int64(n))
+    return n, err
+}
+
+// Stats returns how many bytes have been sent and received over the
+// connections of c, across all of its requests, as they went over the
+// network: with headers, TLS and any proxy handshakes, and bodies as they
+// were compressed. It is safe to call while requests are in progress.
+func (c *Client) Stats() (bytesSent, bytesReceived int64) {
+    return atomic.LoadInt64(&c.traffic.sent), atomic.LoadInt64(&c.traffic.received)
+}
+
+// sessionCache returns the cache for the TLS sessions of c made with the
+// TLS settings identified by tlsKey.
+func (c *Client) sessionCache(tlsKey string) tls.ClientSessionCache {
+    cache := c.TLSSessionCache
+    if cache == nil {
+        c.mu.Lock()
+        if c.sessions == nil {
+            c.sessions = tls.NewLRUClientSessionCache(0)
+        }
+        cache = c.sessions
+        c.mu.Unlock()
+    }
+    return keyedSessionCache{cache, tlsKey}
+}
+
+// keyedSessionCache keeps the sessions made with one set of TLS settings
+// apart from others in a shared cache, by prefixing their keys.
+type keyedSessionCache struct {
+    cache  tls.ClientSessionCache
+    prefix string
+}
+
+func (k keyedSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+    return k.cache.Get(k.prefix + "|" + key)
+}
+
+func (k keyedSessionCache) Put(key string, cs *tls.ClientSessionState) {
+    k.cache.Put(k.prefix+"|"+key, cs)
+}
+
+// NewRequest returns a builder for a request with any method that uses the
+// connections of c.
+func (c *Client) NewRequest(method, url string) *HttpRequestBuilder {
+    b := NewRequest(method, url)
+    b.client = c
+    return b
+}
+
+func (c *Client) Get(url string) *HttpRequestBuilder {
+    return c.NewRequest("GET", url)
+}
+
+func (c *Client) Post(url string) *HttpRequestBuilder {
+    return c.NewRequest("POST", url)
+}
+
+func (c *Client) Put(url string) *HttpRequestBuilder {
+    return c.NewRequest("PUT", url)
+}
+
+func (c *Client) Delete(url string) *HttpRequestBuilder {
+    return c.NewRequest("DELETE", url)
+}
+
+// Pipeline sends the requests back to back on a new connection, without
+// waiting for each response before sending the next, and returns their
+// responses in the same order. The server must support HTTP/1.1 pipelining.
+// The requests must be for the same host with the same connection settings,
+// and use idempotent methods, as pipelining others is unsafe. The timeout of
+// the first request covers the whole pipeline.
+//
+// Each request is sent once, without retries or following redirects, and
+// its response body is read into memory, as the next response can't be read
+// before it. If the server closes the connection part way, the responses
+// received until then are returned with an error for the rest.
+func (c *Client) Pipeline(reqs []*HttpRequestBuilder) ([]*http.Response, error) {
+    if len(reqs) == 0 {
+        return nil, nil
+    }
+    var key string
+    var target *url.URL
+    for i, b := range reqs {
+        if b.err != nil {
+            return nil, b.err
+        }
+        if !isIdempotent(b.req.Method) {
+            return nil, fmt.Errorf("httplib: can't pipeline a %s request, which isn't idempotent", b.req.Method)
+        }
+        u, err := b.newRequest()
+        if err != nil {
+            return nil, err
+        }
+        if i == 0 {
+            key, target = b.poolKey(u), u
+            if key == "" {
+                return nil, errors.New("httplib: only HTTP/1.1 requests can be pipelined")
+            }
+        } else if b.poolKey(u) != key {
+            return nil, errors.New("httplib: pipelined requests must share a host and connection settings")
+        }
+    }
+
+    first := reqs[0]
+    if first.timeout > 0 {
+        first.deadline = time.Now().Add(first.timeout)
+    }
+    conn, err := c.dial(key, target, first.req, first.connOptions())
+    if err != nil {
+        return nil, err
+    }
+    outs := make([]*http.Request, len(reqs))
+    for i, b := range reqs {
+        outs[i] = b.req
+        if conn.proxy != nil {
+            outs[i] = proxyRequest(b.req, conn.proxy)
+        }
+    }
+    // written in the background, so that a server answering before reading
+    // every request can't block the pipeline, with a result per request, as
+    // a response can only be read once its request has been written
+    written := make(chan error, len(reqs))
+    go func() {
+        for i, out := range outs {
+            err := conn.write(out)
+            if reqs[i].req.Body != nil {
+                reqs[i].req.Body.Close()
+            }
+            written <- err
+            if err != nil {
+                return
+            }
+        }
+    }()
+
+    resps := make([]*http.Response, 0, len(reqs))
+    for i, b := range reqs {
+        var resp *http.Response
+        err := <-written
+        if err == nil {
+            resp, err = conn.Read(outs[i])
+        }
+        if err == httputil.ErrPersistEOF && resp != nil {
+            // the last response the server will send on the connection
+            conn.broken = true
+            err = nil
+        }
+        if err == nil && resp.Body != nil {
+            resp.Request = b.req
+            b.resp = resp
+            b.wrapBody(resp)
+            var data []byte
+            data, err = ioutil.ReadAll(resp.Body)
+            resp.Body.Close()
+            resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+        }
+        if err != nil {
+            c.release(conn, false)
+            return resps, fmt.Errorf("httplib: pipeline failed after %d of %d responses: %v", len(resps), len(reqs), err)
+        }
+        resps = append(resps, resp)
+    }
+    c.release(conn, true)
+    return resps, nil
+}
+
+// getIdle takes an idle connection for key out of the pool, or returns nil
+// if there is none.
+func (c *Client) getIdle(key string) *persistConn {
+    if key == "" {
+        return nil
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    conns := c.idle[key]
+    if len(conns) == 0 {
+        return nil
+    }
+    conn := conns[len(conns)-1]
+    c.idle[key] = conns[0 : len(conns)-1]
+    return conn
+}
+
+// dial opens a new connection that will be returned to the pool for key.
+func (c *Client) dial(key string, url *url.URL, req *http.Request, opts *connOptions) (*persistConn, error) {
+    c.mu.Lock()
+    closed := c.closed
+    c.mu.Unlock()
+    if closed {
+        return nil, ErrClientClosed
+    }
+
+    conn, err := dial(url, req, opts)
+    if err != nil {
+        return nil, err
+    }
+    conn.key = key
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        conn.Close()
+        return nil, ErrClientClosed
+    }
+    if c.conns == nil {
+        c.conns = map[*persistConn]bool{}
+    }
+    c.conns[conn] = true
+    return conn, nil
+}
+
+// release puts conn back in the pool if reusable is set and nothing else
+// stops it being reused, or otherwise closes it.
+func (c *Client) release(conn *persistConn, reusable bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !reusable || conn.broken || conn.key == "" || c.closed || !c.conns[conn] {
+        delete(c.conns, conn)
+        conn.Close()
+        return
+    }
+    // the timeouts of the last request must not hit the next one
+    conn.setOptions(nil)
+    if c.idle == nil {
+        c.idle = map[string][]*persistConn{}
+    }
+    c.idle[conn.key] = append(c.idle[conn.key], conn)
+}
+
+// CloseIdleConnections closes the connections kept open for reuse.
+// Connections in use by a request are unaffected.
+func (c *Client) CloseIdleConnections() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, conns := range c.idle {
+        for _, conn := range conns {
+            delete(c.conns, conn)
+            conn.Close()
+        }
+    }
+    c.idle = nil
+}
+
+// Close closes every connection of c, including those of requests still in
+// progress, which then fail. Requests made through c afterwards fail with
+// ErrClientClosed.
+func (c *Client) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.closed = true
+    for conn := range c.conns {
+        conn.Close()
+    }
+    c.conns = nil
+    c.idle = nil
+    return nil
+}
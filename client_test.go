@@ -0,0 +1,869 @@
+package httplib
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func openFDs(t *testing.T) int {
+    fds, err := ioutil.ReadDir("/proc/self/fd")
+    if err != nil {
+        t.Skip("can't count open file descriptors")
+    }
+    return len(fds)
+}
+
+// waitFDs waits for the number of open file descriptors to drop to n, as
+// the server side of closed connections is closed asynchronously.
+func waitFDs(t *testing.T, n int) int {
+    fds := openFDs(t)
+    for i := 0; i < 100 && fds > n; i++ {
+        time.Sleep(10 * time.Millisecond)
+        fds = openFDs(t)
+    }
+    return fds
+}
+
+func TestClientReuse(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    first, err := c.Get(ts.URL).AsString()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    second, _ := c.Get(ts.URL).AsString()
+    if first != second {
+        t.Fatalf("expected the connection to be reused, got %q and %q", first, second)
+    }
+    third, _ := c.Get(ts.URL).DisableKeepAlive().AsString()
+    fourth, _ := c.Get(ts.URL).AsString()
+    if third == first || fourth != first {
+        t.Fatalf("expected Connection: close to use a connection of its own, got %q then %q", third, fourth)
+    }
+}
+
+func TestClientStaleConnection(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    received := make(chan string, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for i := 0; ; i++ {
+                    req, err := http.ReadRequest(r)
+                    if err != nil {
+                        return
+                    }
+                    io.Copy(ioutil.Discard, req.Body)
+                    received <- req.Method
+                    if i == 1 {
+                        // drop the connection after reading the second request
+                        return
+                    }
+                    io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+                }
+            }()
+        }
+    }()
+    url := "http://" + l.Addr().String()
+
+    c := new(Client)
+    defer c.Close()
+    if _, err := c.Get(url).AsString(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.Post(url).Body([]byte("once")).AsString(); err == nil {
+        t.Fatalf("expected the POST to fail on the dropped connection")
+    }
+    if _, err := c.Get(url).AsString(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.Get(url).AsString(); err != nil {
+        t.Fatalf("expected the GET to be resent on a new connection, got %v", err)
+    }
+    close(received)
+    var methods []string
+    for method := range received {
+        methods = append(methods, method)
+    }
+    if got := strings.Join(methods, " "); got != "GET POST GET GET GET" {
+        t.Fatalf("expected the POST to be sent once and the GET resent, got %s", got)
+    }
+}
+
+func TestClientCloseIdleConnections(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    defer ts.Close()
+
+    baseline := openFDs(t)
+    c := new(Client)
+    for i := 0; i < 3; i++ {
+        if _, err := c.Get(ts.URL).AsString(); err != nil {
+            t.Fatalf("request failed: %s", err.Error())
+        }
+    }
+    if openFDs(t) <= baseline {
+        t.Fatalf("expected an idle connection to be kept open")
+    }
+    c.CloseIdleConnections()
+    if fds := waitFDs(t, baseline); fds > baseline {
+        t.Fatalf("expected %d open fds after CloseIdleConnections, got %d", baseline, fds)
+    }
+}
+
+func TestClientClose(t *testing.T) {
+    arrived := make(chan bool)
+    unblock := make(chan bool)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        arrived <- true
+        <-unblock
+    }))
+    defer ts.Close()
+    defer close(unblock)
+
+    c := new(Client)
+    done := make(chan error)
+    go func() {
+        _, err := c.Get(ts.URL).AsString()
+        done <- err
+    }()
+    <-arrived
+    c.Close()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Fatalf("expected the in-flight request to fail")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatalf("Close didn't interrupt the in-flight request")
+    }
+    if _, err := c.Get(ts.URL).AsString(); err != ErrClientClosed {
+        t.Fatalf("expected ErrClientClosed, got %v", err)
+    }
+}
+
+func TestClientAsStatus(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("addr") != "" {
+            w.Write([]byte(r.RemoteAddr))
+            return
+        }
+        w.WriteHeader(http.StatusAccepted)
+        w.Write([]byte(strings.Repeat("x", 1000)))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    first, err := c.Get(ts.URL).Param("addr", "1").AsString()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    if code, err := c.Get(ts.URL).AsStatus(); err != nil || code != http.StatusAccepted {
+        t.Fatalf("unexpected status %d, %v", code, err)
+    }
+    if second, _ := c.Get(ts.URL).Param("addr", "1").AsString(); second != first {
+        t.Fatalf("expected AsStatus to leave the connection reusable, got %q and %q", first, second)
+    }
+
+    if code, err := c.Get(ts.URL).MaxBodySize(10).AsStatus(); err != nil || code != http.StatusAccepted {
+        t.Fatalf("unexpected status %d, %v", code, err)
+    }
+    if third, _ := c.Get(ts.URL).Param("addr", "1").AsString(); third == first {
+        t.Fatalf("expected a body beyond MaxBodySize to close the connection")
+    }
+    if _, err := c.Get(ts.URL).MaxBodySize(10).AsString(); err != ErrBodyTooLarge {
+        t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+    }
+}
+
+func TestClientAsResponseReader(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Remote", r.RemoteAddr)
+        w.Write([]byte(strings.Repeat("x", 100000)))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    remote := func(readAll bool) string {
+        resp, body, err := c.Get(ts.URL).AsResponseReader()
+        if err != nil {
+            t.Fatalf("request failed: %s", err.Error())
+        }
+        if resp.Body != body {
+            t.Fatalf("expected resp.Body to be the returned reader")
+        }
+        if readAll {
+            ioutil.ReadAll(body)
+        } else {
+            body.Read(make([]byte, 10))
+        }
+        body.Close()
+        body.Close()
+        return resp.Header.Get("X-Remote")
+    }
+    first := remote(true)
+    if second := remote(false); second != first {
+        t.Fatalf("expected a body read to the end to return its connection, got %q and %q", first, second)
+    }
+    if third := remote(true); third == first {
+        t.Fatalf("expected closing a body early to close its connection")
+    }
+}
+
+func TestClientAsResponse(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/close" {
+            w.Header().Set("Connection", "close")
+        }
+        w.Write([]byte(r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    stream := func(path string, readAll bool) string {
+        resp, err := c.Get(ts.URL + path).AsResponse()
+        if err != nil {
+            t.Fatalf("request failed: %s", err.Error())
+        }
+        var data []byte
+        if readAll {
+            data, _ = ioutil.ReadAll(resp.Body)
+        } else {
+            resp.Body.Read(make([]byte, 1))
+        }
+        resp.Body.Close()
+        return string(data)
+    }
+    first := stream("/", true)
+    if second := stream("/", true); second != first {
+        t.Fatalf("expected a streamed body to return its connection, got %q and %q", first, second)
+    }
+    stream("/", false)
+    third := stream("/", true)
+    if third == first {
+        t.Fatalf("expected a partly read body to close its connection")
+    }
+    stream("/close", true)
+    if fourth := stream("/", true); fourth == third {
+        t.Fatalf("expected a connection the server closes not to be reused")
+    }
+}
+
+// redirectDialer connects every dial to addr, recording the addresses asked
+// for.
+type redirectDialer struct {
+    addr   string
+    dialed []string
+}
+
+func (d *redirectDialer) Dial(network, addr string) (net.Conn, error) {
+    d.dialed = append(d.dialed, addr)
+    return net.Dial(network, d.addr)
+}
+
+func TestDialer(t *testing.T) {
+    // the test certificate is valid for example.com
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("dialed " + r.Host))
+    }))
+    defer ts.Close()
+
+    d := &redirectDialer{addr: ts.Listener.Addr().String()}
+    c := &Client{Dialer: d}
+    defer c.Close()
+    s, err := c.Get("https://example.com/").TLSConfig(trustServer(ts)).AsString()
+    if err != nil || s != "dialed example.com" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if len(d.dialed) != 1 || d.dialed[0] != "example.com:443" {
+        t.Fatalf("expected the Client dialer to dial example.com:443, got %v", d.dialed)
+    }
+
+    own := &redirectDialer{addr: ts.Listener.Addr().String()}
+    s, err = c.Get("https://example.com:8443/").TLSConfig(trustServer(ts)).Dialer(own).AsString()
+    if err != nil || s != "dialed example.com:8443" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if len(own.dialed) != 1 || len(d.dialed) != 1 {
+        t.Fatalf("expected the request dialer to be used instead, got %v and %v", own.dialed, d.dialed)
+    }
+}
+
+func TestClientTimeoutReuse(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    first, err := c.Get(ts.URL).TimeoutMillis(50).AsString()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    // the deadline of the first request has passed by the second
+    time.Sleep(100 * time.Millisecond)
+    second, err := c.Get(ts.URL).AsString()
+    if err != nil || second != first {
+        t.Fatalf("expected the pooled connection to be reused without a deadline, got %q, %v", second, err)
+    }
+}
+
+func TestClientPipeline(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/close" {
+            w.Header().Set("Connection", "close")
+        }
+        w.Write([]byte(r.URL.Path + " " + r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    var reqs []*HttpRequestBuilder
+    for _, path := range []string{"/1", "/2", "/3", "/4"} {
+        reqs = append(reqs, c.Get(ts.URL+path))
+    }
+    resps, err := c.Pipeline(reqs)
+    if err != nil || len(resps) != 4 {
+        t.Fatalf("expected 4 responses, got %d, %v", len(resps), err)
+    }
+    var addr string
+    for i, resp := range resps {
+        body, _ := ioutil.ReadAll(resp.Body)
+        fields := strings.Fields(string(body))
+        if fields[0] != reqs[i].req.URL.Path || addr != "" && fields[1] != addr {
+            t.Fatalf("expected %s on one connection, got %q after %s", reqs[i].req.URL.Path, body, addr)
+        }
+        addr = fields[1]
+    }
+    if s, _ := c.Get(ts.URL + "/after").AsString(); s != "/after "+addr {
+        t.Fatalf("expected the connection to be pooled afterwards, got %q for %s", s, addr)
+    }
+
+    resps, err = c.Pipeline([]*HttpRequestBuilder{c.Get(ts.URL + "/1"), c.Get(ts.URL + "/close"), c.Get(ts.URL + "/3")})
+    if err == nil || len(resps) != 2 {
+        t.Fatalf("expected the requests after the connection closed to fail, got %d responses, %v", len(resps), err)
+    }
+    if _, err := c.Pipeline([]*HttpRequestBuilder{c.Get(ts.URL), c.Post(ts.URL)}); err == nil {
+        t.Fatalf("expected an error for pipelining a POST")
+    }
+    if _, err := c.Pipeline([]*HttpRequestBuilder{c.Get(ts.URL), c.Get("http://example.com/")}); err == nil {
+        t.Fatalf("expected an error for pipelining to different hosts")
+    }
+}
+
+func TestDialControl(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    defer ts.Close()
+
+    var calls []string
+    control := func(network, address string, c syscall.RawConn) error {
+        calls = append(calls, network+" "+address)
+        return nil
+    }
+    if s, err := Get(ts.URL).DialControl(control).AsString(); err != nil || s != "ok" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if len(calls) != 1 || calls[0] != "tcp4 "+ts.Listener.Addr().String() {
+        t.Fatalf("expected the control function to be called for the dial, got %q", calls)
+    }
+
+    // a Client dialer keeps its own settings, and its control runs first
+    calls = nil
+    c := &Client{Dialer: &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+        calls = append(calls, "client")
+        return nil
+    }}}
+    defer c.Close()
+    c.Get(ts.URL).DialControl(control).AsString()
+    if len(calls) != 2 || calls[0] != "client" {
+        t.Fatalf("expected both control functions to be called, got %q", calls)
+    }
+
+    refuse := func(network, address string, c syscall.RawConn) error {
+        return errors.New("refused by control")
+    }
+    if _, err := Get(ts.URL).DialControl(refuse).AsString(); err == nil || !strings.Contains(err.Error(), "refused by control") {
+        t.Fatalf("expected the control error, got %v", err)
+    }
+}
+
+func TestAbort(t *testing.T) {
+    done := make(chan bool)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.RemoteAddr + "\n"))
+        w.(http.Flusher).Flush()
+        for {
+            select {
+            case <-done:
+                return
+            case <-r.Context().Done():
+                return
+            case <-time.After(10 * time.Millisecond):
+                if r.URL.Path == "/stream" {
+                    w.Write([]byte("line\n"))
+                    w.(http.Flusher).Flush()
+                }
+            }
+        }
+    }))
+    defer ts.Close()
+    defer close(done)
+
+    c := new(Client)
+    defer c.Close()
+    b := c.Get(ts.URL + "/stream")
+    var lines []string
+    err := b.StreamLines(func(line string) bool {
+        lines = append(lines, line)
+        if len(lines) == 3 {
+            b.Abort()
+        }
+        return true
+    })
+    if err != ErrAborted || len(lines) != 3 {
+        t.Fatalf("expected ErrAborted after 3 lines, got %v after %d", err, len(lines))
+    }
+
+    b = c.Get(ts.URL + "/hang")
+    _, body, err := b.AsResponseReader()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    time.AfterFunc(50*time.Millisecond, body.Abort)
+    start := time.Now()
+    if _, err := ioutil.ReadAll(body); err != ErrAborted {
+        t.Fatalf("expected ErrAborted, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("expected the read to stop at the abort, took %s", elapsed)
+    }
+    body.Close()
+    if _, err := b.AsString(); err != ErrAborted {
+        t.Fatalf("expected further requests to fail with ErrAborted, got %v", err)
+    }
+    c.mu.Lock()
+    idle, open := len(c.idle[b.poolKey(b.req.URL)]), len(c.conns)
+    c.mu.Unlock()
+    if idle != 0 || open != 0 {
+        t.Fatalf("expected aborted connections to be discarded, got %d idle of %d open", idle, open)
+    }
+}
+
+// writeCounter counts the writes to the connections it dials.
+type writeCounter struct {
+    writes int
+}
+
+func (d *writeCounter) Dial(network, addr string) (net.Conn, error) {
+    conn, err := net.Dial(network, addr)
+    if err != nil {
+        return nil, err
+    }
+    return &countedConn{conn, d}, nil
+}
+
+type countedConn struct {
+    net.Conn
+    d *writeCounter
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+    c.d.writes++
+    return c.Conn.Write(p)
+}
+
+// smallReads reads n zeros, 100 bytes at a time.
+type smallReads struct {
+    n int
+}
+
+func (r *smallReads) Read(p []byte) (int, error) {
+    if r.n == 0 {
+        return 0, io.EOF
+    }
+    if len(p) > 100 {
+        p = p[:100]
+    }
+    if len(p) > r.n {
+        p = p[:r.n]
+    }
+    for i := range p {
+        p[i] = 0
+    }
+    r.n -= len(p)
+    return len(p), nil
+}
+
+func TestWriteBufferSize(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        n, _ := io.Copy(ioutil.Discard, r.Body)
+        fmt.Fprint(w, n)
+    }))
+    defer ts.Close()
+
+    writes := func(size int) int {
+        d := &writeCounter{}
+        c := &Client{Dialer: d, WriteBufferSize: size}
+        defer c.Close()
+        for i := 0; i < 2; i++ {
+            s, err := c.Post(ts.URL).Body(&smallReads{256 << 10}).AsString()
+            if err != nil || s != "262144" {
+                t.Fatalf("expected the body to be sent in full, got %q, %v", s, err)
+            }
+        }
+        return d.writes
+    }
+    unbuffered, buffered := writes(0), writes(64<<10)
+    if buffered*4 > unbuffered {
+        t.Fatalf("expected far fewer writes with a 64KB buffer, got %d, against %d", buffered, unbuffered)
+    }
+}
+
+func BenchmarkWriteBufferSize(b *testing.B) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(ioutil.Discard, r.Body)
+    }))
+    defer ts.Close()
+
+    for _, size := range []int{0, 64 << 10} {
+        b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+            c := &Client{WriteBufferSize: size}
+            defer c.Close()
+            b.SetBytes(4 << 20)
+            for i := 0; i < b.N; i++ {
+                if _, err := c.Post(ts.URL).Body(&smallReads{4 << 20}).AsBytes(); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// readCounter counts the reads from the connections it dials.
+type readCounter struct {
+    reads int
+}
+
+func (d *readCounter) Dial(network, addr string) (net.Conn, error) {
+    conn, err := net.Dial(network, addr)
+    if err != nil {
+        return nil, err
+    }
+    return &readCountedConn{conn, d}, nil
+}
+
+type readCountedConn struct {
+    net.Conn
+    d *readCounter
+}
+
+func (c *readCountedConn) Read(p []byte) (int, error) {
+    c.d.reads++
+    return c.Conn.Read(p)
+}
+
+func TestReadBufferSize(t *testing.T) {
+    body := strings.Repeat("x", 1<<20)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(body))
+    }))
+    defer ts.Close()
+
+    reads := func(size int) int {
+        d := &readCounter{}
+        c := &Client{Dialer: d, ReadBufferSize: size}
+        defer c.Close()
+        for i := 0; i < 2; i++ {
+            resp, err := c.Get(ts.URL).AsResponse()
+            if err != nil {
+                t.Fatal(err)
+            }
+            // small reads, which are served from the buffer
+            r := bufio.NewReaderSize(resp.Body, 16)
+            n, err := io.Copy(ioutil.Discard, struct{ io.Reader }{r})
+            resp.Body.Close()
+            if err != nil || n != int64(len(body)) {
+                t.Fatalf("expected the body to be read in full, got %d bytes, %v", n, err)
+            }
+        }
+        return d.reads
+    }
+    small, large := reads(0), reads(256<<10)
+    if large*4 > small {
+        t.Fatalf("expected far fewer reads with a 256KB buffer, got %d, against %d", large, small)
+    }
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+    body := strings.Repeat("x", 4<<20)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(body))
+    }))
+    defer ts.Close()
+
+    for _, size := range []int{0, 256 << 10} {
+        b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+            c := &Client{ReadBufferSize: size}
+            defer c.Close()
+            b.SetBytes(int64(len(body)))
+            buf := make([]byte, 1024)
+            for i := 0; i < b.N; i++ {
+                resp, err := c.Get(ts.URL).AsResponse()
+                if err != nil {
+                    b.Fatal(err)
+                }
+                // read in small pieces, as a decoder or scanner would
+                for err == nil {
+                    _, err = resp.Body.Read(buf)
+                }
+                resp.Body.Close()
+                if err != io.EOF {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+func TestClientStats(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(ioutil.Discard, r.Body)
+        w.Write([]byte(strings.Repeat("r", 2000)))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    if sent, received := c.Stats(); sent != 0 || received != 0 {
+        t.Fatalf("expected no traffic yet, got %d, %d", sent, received)
+    }
+    done := make(chan error)
+    for i := 0; i < 4; i++ {
+        go func() {
+            _, err := c.Post(ts.URL).Body(strings.Repeat("s", 1000)).AsString()
+            done <- err
+        }()
+    }
+    for i := 0; i < 4; i++ {
+        if err := <-done; err != nil {
+            t.Fatal(err)
+        }
+    }
+    sent, received := c.Stats()
+    // the bodies and some headers
+    if sent < 4*1000 || sent > 4*1500 || received < 4*2000 || received > 4*2500 {
+        t.Fatalf("unexpected traffic: %d bytes sent, %d received", sent, received)
+    }
+    if _, err := Get(ts.URL).AsString(); err != nil {
+        t.Fatal(err)
+    }
+    if s, r := c.Stats(); s != sent || r != received {
+        t.Fatalf("expected requests outside the client not to count, got %d, %d", s, r)
+    }
+}
+
+func TestPauseResume(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(strings.Repeat("x", 1<<20)))
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL)
+    _, body, err := b.AsResponseReader()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    defer body.Close()
+    head := make([]byte, 1000)
+    if _, err := io.ReadFull(body, head); err != nil {
+        t.Fatal(err)
+    }
+    b.Pause()
+    done := make(chan int)
+    go func() {
+        rest, err := ioutil.ReadAll(body)
+        if err != nil {
+            t.Error(err)
+        }
+        done <- len(rest)
+    }()
+    select {
+    case <-done:
+        t.Fatalf("expected reads to wait while paused")
+    case <-time.After(100 * time.Millisecond):
+    }
+    b.Resume()
+    if n := <-done; n != 1<<20-1000 {
+        t.Fatalf("expected the rest of the body after resuming, got %d bytes", n)
+    }
+}
+
+func TestAsBytesInto(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.URL.Path[1:]))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    buf := make([]byte, 5)
+    for _, body := range []string{"hi", "hello", ""} {
+        n, err := c.Get(ts.URL + "/" + body).AsBytesInto(buf)
+        if err != nil || string(buf[:n]) != body {
+            t.Fatalf("expected %q, got %q, %v", body, buf[:n], err)
+        }
+    }
+    c.mu.Lock()
+    open := len(c.conns)
+    c.mu.Unlock()
+    if open != 1 {
+        t.Fatalf("expected the connection to be reused, got %d open", open)
+    }
+    n, err := c.Get(ts.URL + "/hello world").AsBytesInto(buf)
+    if err != ErrBufferTooSmall || string(buf[:n]) != "hello" {
+        t.Fatalf("expected ErrBufferTooSmall with the start of the body, got %q, %v", buf[:n], err)
+    }
+}
+
+// noSessionCache is a TLS session cache that keeps nothing.
+type noSessionCache struct{}
+
+func (noSessionCache) Get(string) (*tls.ClientSessionState, bool) { return nil, false }
+func (noSessionCache) Put(string, *tls.ClientSessionState)        {}
+
+func TestTLSSessionCache(t *testing.T) {
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("secure"))
+    }))
+    defer ts.Close()
+    config := trustServer(ts)
+
+    for _, c := range []*Client{new(Client), {TLSSessionCache: noSessionCache{}}} {
+        var resumed []bool
+        for i := 0; i < 2; i++ {
+            // a new connection for each request
+            b := c.Get(ts.URL).TLSConfig(config).Header("Connection", "close")
+            state, err := b.TLSState()
+            if err != nil {
+                t.Fatal(err)
+            }
+            resumed = append(resumed, state.DidResume)
+        }
+        c.Close()
+        _, cached := c.TLSSessionCache.(noSessionCache)
+        if resumed[0] || resumed[1] == cached {
+            t.Fatalf("unexpected resumptions %v with cache %T", resumed, c.TLSSessionCache)
+        }
+    }
+}
+
+// clientCert returns a self-signed client certificate for name.
+func clientCert(t *testing.T, name string) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: name},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSSessionCacheClientCerts(t *testing.T) {
+    ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+    }))
+    ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+    ts.StartTLS()
+    defer ts.Close()
+    configs := map[string]*tls.Config{}
+    for _, name := range []string{"alice", "bob"} {
+        configs[name] = trustServer(ts)
+        configs[name].Certificates = []tls.Certificate{clientCert(t, name)}
+    }
+
+    c := new(Client)
+    defer c.Close()
+    for i, name := range []string{"alice", "alice", "bob"} {
+        b := c.Get(ts.URL).TLSConfig(configs[name]).Header("Connection", "close")
+        s, err := b.AsString()
+        if err != nil {
+            t.Fatal(err)
+        }
+        state, _ := b.TLSState()
+        if s != name || state.DidResume != (i == 1) {
+            t.Fatalf("request %d as %s: server saw %s, resumed %t", i, name, s, state.DidResume)
+        }
+    }
+}
+
+func BenchmarkTLSHandshake(b *testing.B) {
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+    config := trustServer(ts)
+
+    for _, bench := range []struct {
+        name   string
+        client *Client
+    }{
+        {"Resumed", new(Client)},
+        {"Full", &Client{TLSSessionCache: noSessionCache{}}},
+    } {
+        defer bench.client.Close()
+        b.Run(bench.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                if _, err := bench.client.Get(ts.URL).TLSConfig(config).Header("Connection", "close").AsBytes(); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
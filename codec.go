@@ -0,0 +1,148 @@
+package httplib
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "mime"
+    "strings"
+    "sync"
+)
+
+var (
+    codecMu  sync.RWMutex
+    encoders = map[string]func(interface{}) ([]byte, error){
+        "application/json": json.Marshal,
+        "application/xml":  xml.Marshal,
+        "text/xml":         xml.Marshal,
+    }
+    decoders = map[string]func([]byte, interface{}) error{
+        "application/json": json.Unmarshal,
+        "application/xml":  xml.Unmarshal,
+        "text/xml":         xml.Unmarshal,
+    }
+)
+
+// RegisterEncoder sets the function BodyAs uses to marshal request bodies of
+// the given content type, such as "application/msgpack". JSON and XML are
+// registered by default.
+func RegisterEncoder(contentType string, fn func(v interface{}) ([]byte, error)) {
+    codecMu.Lock()
+    defer codecMu.Unlock()
+    encoders[strings.ToLower(contentType)] = fn
+}
+
+// BodyAs marshals v with the encoder registered for contentType and sends
+// it as the request body with that Content-Type.
+func (b *HttpRequestBuilder) BodyAs(contentType string, v interface{}) *HttpRequestBuilder {
+    codecMu.RLock()
+    encode := encoders[strings.ToLower(contentType)]
+    codecMu.RUnlock()
+    if encode == nil {
+        if b.err == nil {
+            b.err = fmt.Errorf("httplib: no encoder registered for %s", contentType)
+        }
+        return b
+    }
+    data, err := encode(v)
+    if err != nil {
+        if b.err == nil {
+            b.err = err
+        }
+        return b
+    }
+    return b.Header("Content-Type", contentType).Body(data)
+}
+
+// BodyJSON sends v marshalled as JSON.
+func (b *HttpRequestBuilder) BodyJSON(v interface{}) *HttpRequestBuilder {
+    return b.BodyAs("application/json", v)
+}
+
+// BodyXML sends v marshalled as XML.
+func (b *HttpRequestBuilder) BodyXML(v interface{}) *HttpRequestBuilder {
+    return b.BodyAs("application/xml", v)
+}
+
+// RegisterDecoder sets the function As uses to unmarshal response bodies of
+// the given content type. JSON and XML are registered by default.
+func RegisterDecoder(contentType string, fn func(data []byte, v interface{}) error) {
+    codecMu.Lock()
+    defer codecMu.Unlock()
+    decoders[strings.ToLower(contentType)] = fn
+}
+
+// decoderFor returns the decoder for a Content-Type header value, ignoring
+// its parameters. Types with a +json or +xml suffix, such as
+// application/problem+json, fall back to the JSON or XML decoder.
+func decoderFor(contentType string) func([]byte, interface{}) error {
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        return nil
+    }
+    codecMu.RLock()
+    defer codecMu.RUnlock()
+    if decode := decoders[mediaType]; decode != nil {
+        return decode
+    }
+    if strings.HasSuffix(mediaType, "+json") {
+        return decoders["application/json"]
+    }
+    if strings.HasSuffix(mediaType, "+xml") {
+        return decoders["application/xml"]
+    }
+    return nil
+}
+
+// As unmarshals the response body into v with the decoder registered for
+// the Content-Type of the response.
+func (b *HttpRequestBuilder) As(v interface{}) error {
+    resp, err := b.getResponse()
+    if err != nil {
+        return err
+    }
+    contentType := resp.Header.Get("Content-Type")
+    decode := decoderFor(contentType)
+    if decode == nil {
+        b.Close()
+        return fmt.Errorf("httplib: no decoder registered for Content-Type %q", contentType)
+    }
+    data, err := b.readAll(resp)
+    if err != nil {
+        return err
+    }
+    return decode(data, v)
+}
+
+// GetJSON fetches url and decodes its JSON body into v. A status other than
+// 2xx fails with a *StatusError.
+func GetJSON(url string, v interface{}) error {
+    return Get(url).decodeJSON(v)
+}
+
+// PostJSON posts body marshalled as JSON to url and decodes the JSON
+// response into v, which may be nil to ignore it. A status other than 2xx
+// fails with a *StatusError.
+func PostJSON(url string, body, v interface{}) error {
+    return Post(url).BodyJSON(body).decodeJSON(v)
+}
+
+// decodeJSON makes the request asking for JSON, checks that the status is
+// 2xx and decodes the response into v. An empty body, as from a 204, leaves
+// v alone.
+func (b *HttpRequestBuilder) decodeJSON(v interface{}) error {
+    if b.req.Header.Get("Accept") == "" {
+        b.Header("Accept", "application/json")
+    }
+    data, err := b.AsBytes()
+    if err != nil {
+        return err
+    }
+    if b.resp.StatusCode/100 != 2 {
+        return newStatusError(b.resp, data)
+    }
+    if v == nil || len(data) == 0 {
+        return nil
+    }
+    return json.Unmarshal(data, v)
+}
@@ -0,0 +1,186 @@
+package httplib
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func echoServer() *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write([]byte(r.Header.Get("Content-Type") + " " + string(body)))
+    }))
+}
+
+func TestBodyAs(t *testing.T) {
+    ts := echoServer()
+    defer ts.Close()
+
+    type item struct {
+        Name string `json:"name" xml:"name"`
+    }
+    s, err := Post(ts.URL).BodyJSON(item{"go"}).AsString()
+    if err != nil || s != `application/json {"name":"go"}` {
+        t.Fatalf("unexpected JSON body %q, %v", s, err)
+    }
+    s, err = Post(ts.URL).BodyXML(item{"go"}).AsString()
+    if err != nil || s != `application/xml <item><name>go</name></item>` {
+        t.Fatalf("unexpected XML body %q, %v", s, err)
+    }
+
+    RegisterEncoder("text/x-upper", func(v interface{}) ([]byte, error) {
+        s, ok := v.(string)
+        if !ok {
+            return nil, errors.New("not a string")
+        }
+        return []byte(strings.ToUpper(s)), nil
+    })
+    s, err = Post(ts.URL).BodyAs("text/x-upper", "shout").AsString()
+    if err != nil || s != "text/x-upper SHOUT" {
+        t.Fatalf("unexpected custom body %q, %v", s, err)
+    }
+    if _, err := Post(ts.URL).BodyAs("text/x-upper", 1).AsString(); err == nil {
+        t.Fatalf("expected the encoder error")
+    }
+    _, err = Post(ts.URL).BodyAs("application/x-unknown", 1).AsString()
+    if err == nil || !strings.Contains(err.Error(), "application/x-unknown") {
+        t.Fatalf("expected an error for an unknown content type, got %v", err)
+    }
+    _, err = Post(ts.URL).BodyJSON(func() {}).AsString()
+    if err == nil {
+        t.Fatalf("expected a marshalling error")
+    }
+}
+
+func TestAs(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+        w.Write([]byte(r.URL.Query().Get("body")))
+    }))
+    defer ts.Close()
+
+    type item struct {
+        Name string `json:"name" xml:"name"`
+    }
+    for contentType, body := range map[string]string{
+        "application/json; charset=utf-8": `{"name":"go"}`,
+        "application/problem+json":        `{"name":"go"}`,
+        "text/xml":                        `<item><name>go</name></item>`,
+    } {
+        var v item
+        err := Get(ts.URL).Param("type", contentType).Param("body", body).As(&v)
+        if err != nil || v.Name != "go" {
+            t.Fatalf("%s: unexpected result %+v, %v", contentType, v, err)
+        }
+    }
+
+    RegisterDecoder("text/x-upper", func(data []byte, v interface{}) error {
+        *v.(*string) = strings.ToUpper(string(data))
+        return nil
+    })
+    var s string
+    if err := Get(ts.URL).Param("type", "text/x-upper").Param("body", "quiet").As(&s); err != nil || s != "QUIET" {
+        t.Fatalf("unexpected custom decoding %q, %v", s, err)
+    }
+    err := Get(ts.URL).Param("type", "text/html").Param("body", "<html>").As(&s)
+    if err == nil || !strings.Contains(err.Error(), "text/html") {
+        t.Fatalf("expected an error for an unregistered type, got %v", err)
+    }
+}
+
+func TestGetJSON(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/item":
+            got := "null"
+            if r.Method == "POST" {
+                body, _ := ioutil.ReadAll(r.Body)
+                got = string(body)
+            }
+            fmt.Fprintf(w, `{"name":"go","accept":%q,"got":%s}`, r.Header.Get("Accept"), got)
+        case "/none":
+            w.WriteHeader(204)
+        default:
+            http.Error(w, `{"error":"no such item"}`, 404)
+        }
+    }))
+    defer ts.Close()
+
+    type item struct {
+        Name   string
+        Accept string
+        Got    map[string]int
+    }
+    var v item
+    if err := GetJSON(ts.URL+"/item", &v); err != nil || v.Name != "go" || v.Accept != "application/json" {
+        t.Fatalf("unexpected result %+v, %v", v, err)
+    }
+    v = item{}
+    if err := PostJSON(ts.URL+"/item", map[string]int{"n": 1}, &v); err != nil || v.Got["n"] != 1 {
+        t.Fatalf("unexpected result %+v, %v", v, err)
+    }
+    if err := PostJSON(ts.URL+"/none", 1, &v); err != nil {
+        t.Fatalf("expected a 204 to succeed, got %v", err)
+    }
+    err := GetJSON(ts.URL+"/missing", &v)
+    var statusErr *StatusError
+    if !errors.As(err, &statusErr) || statusErr.StatusCode != 404 || !strings.Contains(string(statusErr.Body), "no such item") {
+        t.Fatalf("expected a StatusError with the body, got %v", err)
+    }
+    if !strings.Contains(err.Error(), "404 Not Found") {
+        t.Fatalf("expected the status in the error, got %q", err.Error())
+    }
+}
+
+func TestOnErrorDecode(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/json":
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(422)
+            w.Write([]byte(`{"code":"invalid","message":"name is required"}`))
+        case "/html":
+            http.Error(w, "<h1>Bad Gateway</h1>", 502)
+        default:
+            w.Write([]byte("ok"))
+        }
+    }))
+    defer ts.Close()
+
+    type apiError struct {
+        Code    string
+        Message string
+    }
+    var apiErr apiError
+    b := Get(ts.URL + "/json").OnErrorDecode(&apiErr)
+    _, err := b.AsString()
+    var statusErr *StatusError
+    if !errors.As(err, &statusErr) || statusErr.StatusCode != 422 {
+        t.Fatalf("expected a StatusError, got %v", err)
+    }
+    if detail, ok := statusErr.Detail.(*apiError); !ok || detail.Code != "invalid" || detail.Message != "name is required" {
+        t.Fatalf("expected the decoded error body, got %#v", statusErr.Detail)
+    }
+    if code, _ := b.StatusCode(); code != 422 {
+        t.Fatalf("expected the status code to be kept, got %d", code)
+    }
+
+    _, err = Get(ts.URL + "/html").OnErrorDecode(&apiError{}).AsString()
+    if !errors.As(err, &statusErr) || statusErr.Detail != nil || !strings.Contains(string(statusErr.Body), "Bad Gateway") {
+        t.Fatalf("expected a StatusError with the start of the body, got %#v", err)
+    }
+    if s, err := Get(ts.URL).CheckStatus().AsString(); err != nil || s != "ok" {
+        t.Fatalf("expected a successful response, got %q, %v", s, err)
+    }
+    if _, err := Get(ts.URL + "/html").CheckStatus().AsString(); !errors.As(err, &statusErr) || statusErr.StatusCode != 502 {
+        t.Fatalf("expected a StatusError, got %v", err)
+    }
+    if s, err := Get(ts.URL + "/html").AsString(); err != nil || !strings.Contains(s, "Bad Gateway") {
+        t.Fatalf("expected the error response without CheckStatus, got %q, %v", s, err)
+    }
+}
@@ -1,256 +1,4088 @@
 package httplib
 
 import (
+    "bufio"
     "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
     "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "html"
     "io"
     "io/ioutil"
+    "mime"
+    "mime/multipart"
     "net"
     "net/http"
     "net/http/httputil"
+    "net/textproto"
     "net/url"
     "os"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "syscall"
+    "time"
+    "unicode/utf8"
 )
 
 var defaultUserAgent = "httplib.go"
 
 var debugprint = false
 
-type Client struct {
-    conn    *httputil.ClientConn
-    lastURL *url.URL
+// defaultMaxRetryAfter caps the wait asked for by a Retry-After header,
+// unless changed with MaxRetryAfter.
+var defaultMaxRetryAfter = time.Minute
+
+// ErrDowngrade is returned when NoDowngrade is set and a redirect would move
+// the request from https to plain http.
+var ErrDowngrade = errors.New("httplib: refusing redirect from https to http")
+
+// ErrStopPages can be returned by the callback of AllPages to stop at the
+// current page without AllPages failing.
+var ErrStopPages = errors.New("httplib: stop fetching pages")
+
+// defaultMaxPages is how many pages AllPages fetches unless MaxPages says
+// otherwise.
+const defaultMaxPages = 1000
+
+// ErrFirstByteTimeout is returned when the response doesn't start within
+// the FirstByteTimeout of the request.
+var ErrFirstByteTimeout = errors.New("httplib: timed out waiting for the first byte of the response")
+
+// ErrAborted is returned for a request stopped by Abort.
+var ErrAborted = errors.New("httplib: request aborted")
+
+// ErrBodyTooLarge is returned when a body is larger than MaxBodySize.
+var ErrBodyTooLarge = errors.New("httplib: body exceeds MaxBodySize")
+
+// ErrBufferTooSmall is returned by AsBytesInto for a body larger than the
+// buffer it is read into.
+var ErrBufferTooSmall = errors.New("httplib: body exceeds the buffer")
+
+// StatusError is returned for a response with an unsuccessful status code
+// by the methods that check it, such as GetJSON, and with CheckStatus. Body
+// holds the start of the response body, which often explains the failure.
+type StatusError struct {
+    StatusCode int
+    Status     string
+    Body       []byte
+    // Detail is the value given to OnErrorDecode, once the body has been
+    // decoded into it, or nil if the body isn't valid JSON or there was no
+    // value to decode it into.
+    Detail interface{}
+}
+
+func (e *StatusError) Error() string {
+    if len(e.Body) == 0 {
+        return "httplib: unexpected status " + e.Status
+    }
+    return fmt.Sprintf("httplib: unexpected status %s: %q", e.Status, e.Body)
+}
+
+// TruncatedError is returned when a response body ends short of the length
+// its Content-Length declared, such as when the connection drops during a
+// download. It unwraps to io.ErrUnexpectedEOF. See AllowTruncatedBody.
+type TruncatedError struct {
+    Read, ContentLength int64
+}
+
+func (e *TruncatedError) Error() string {
+    return fmt.Sprintf("httplib: body ended after %d of %d bytes", e.Read, e.ContentLength)
+}
+
+func (e *TruncatedError) Unwrap() error {
+    return io.ErrUnexpectedEOF
+}
+
+// newStatusError returns a StatusError for resp with the start of body.
+func newStatusError(resp *http.Response, body []byte) *StatusError {
+    if len(body) > snippetSize {
+        body = body[:snippetSize]
+    }
+    return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
 }
 
 type nopCloser struct {
     io.Reader
 }
 
-func (nopCloser) Close() error { return nil }
-
-func getNopCloser(buf *bytes.Buffer) nopCloser {
-    return nopCloser{buf}
+func (nopCloser) Close() error { return nil }
+
+func getNopCloser(buf *bytes.Buffer) nopCloser {
+    return nopCloser{buf}
+}
+
+// throttledReader limits reads from r to rate bytes per second using a token
+// bucket holding at most one second's worth of tokens.
+type throttledReader struct {
+    r      io.ReadCloser
+    rate   int64
+    tokens int64
+    last   time.Time
+}
+
+func newThrottledReader(r io.ReadCloser, rate int64) *throttledReader {
+    return &throttledReader{r: r, rate: rate, last: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+    now := time.Now()
+    t.tokens += int64(now.Sub(t.last).Seconds() * float64(t.rate))
+    if t.tokens > t.rate {
+        t.tokens = t.rate
+    }
+    t.last = now
+
+    need := int64(len(p))
+    if need > t.rate {
+        need = t.rate
+    }
+    if t.tokens < need {
+        wait := time.Duration(float64(need-t.tokens) / float64(t.rate) * float64(time.Second))
+        time.Sleep(wait)
+        t.tokens = need
+        t.last = t.last.Add(wait)
+    }
+    n, err := t.r.Read(p[0:need])
+    t.tokens -= int64(n)
+    return n, err
+}
+
+func (t *throttledReader) Close() error { return t.r.Close() }
+
+// readCloser pairs a reader with the closer of the stream it reads from.
+type readCloser struct {
+    io.Reader
+    io.Closer
+}
+
+// connCloser closes the connection a response was read from along with its
+// body.
+type connCloser struct {
+    io.ReadCloser
+    conn *persistConn
+}
+
+func (c connCloser) Close() error {
+    err := c.ReadCloser.Close()
+    c.conn.Close()
+    return err
+}
+
+// responseBody is a response body handed over to the caller, which releases
+// the connection of the builder when closed: to the Client pool if the body
+// was read to the end and the connection can be reused, otherwise by closing
+// it.
+type responseBody struct {
+    io.ReadCloser
+    b      *HttpRequestBuilder
+    eof    bool
+    closed bool
+}
+
+func (r *responseBody) Read(p []byte) (int, error) {
+    n, err := r.ReadCloser.Read(p)
+    if err == io.EOF {
+        r.eof = true
+    }
+    return n, err
+}
+
+func (r *responseBody) Close() error {
+    if r.closed {
+        return nil
+    }
+    r.closed = true
+    var err error
+    if !r.eof {
+        err = r.ReadCloser.Close()
+    }
+    r.b.release(r.eof)
+    return err
+}
+
+// Abort aborts the request the body belongs to, see
+// HttpRequestBuilder.Abort.
+func (r *responseBody) Abort() {
+    r.b.Abort()
+}
+
+// StreamReader is a response body returned by AsResponseReader. Besides
+// reading and closing it, it can be aborted, closing the connection straight
+// away, to stop a large or endless body early.
+type StreamReader interface {
+    io.ReadCloser
+    Abort()
+}
+
+// hasBody reports whether resp has a body, if possibly an empty one. A
+// response to a HEAD request or with a 1xx, 204 or 304 status has none.
+func hasBody(resp *http.Response) bool {
+    if resp.Body == nil || resp.Request != nil && resp.Request.Method == "HEAD" {
+        return false
+    }
+    return resp.StatusCode/100 != 1 && resp.StatusCode != 204 && resp.StatusCode != 304
+}
+
+// lengthChecker fails a body that ends short of its Content-Length with a
+// TruncatedError, or with allowShort ends it there quietly.
+type lengthChecker struct {
+    io.ReadCloser
+    read, length int64
+    allowShort   bool
+}
+
+func (l *lengthChecker) Read(p []byte) (int, error) {
+    n, err := l.ReadCloser.Read(p)
+    l.read += int64(n)
+    if (err == io.EOF || err == io.ErrUnexpectedEOF) && l.read < l.length {
+        if l.allowShort {
+            return n, io.EOF
+        }
+        return n, &TruncatedError{Read: l.read, ContentLength: l.length}
+    }
+    return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+    io.ReadCloser
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.ReadCloser.Read(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// contentCoding returns the content coding of the body of resp to
+// decompress, "gzip" or "deflate", or "" if it has none that can be. A
+// response that can't have a body, or has an empty one, is left alone even
+// if it has a stray Content-Encoding header.
+func contentCoding(resp *http.Response) string {
+    if !hasBody(resp) || resp.ContentLength == 0 {
+        return ""
+    }
+    return headerCoding(resp.Header)
+}
+
+// headerCoding returns the content coding named by the Content-Encoding of
+// header, if it is one that can be decompressed.
+func headerCoding(header http.Header) string {
+    switch strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))) {
+    case "gzip", "x-gzip":
+        return "gzip"
+    case "deflate":
+        return "deflate"
+    }
+    return ""
+}
+
+// newDecoder returns a reader of r decompressed from coding. A deflate body
+// is meant to be zlib wrapped, but as some servers send raw deflate data,
+// that is accepted too. An empty body reads as empty rather than as a
+// truncated stream.
+func newDecoder(coding string, r io.Reader) (io.Reader, error) {
+    if coding == "gzip" {
+        return gzip.NewReader(r)
+    }
+    br := bufio.NewReader(r)
+    head, err := br.Peek(2)
+    if len(head) == 0 {
+        return nil, err
+    }
+    if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+        return zlib.NewReader(br)
+    }
+    return flate.NewReader(br), nil
+}
+
+// decodedBody marks resp as decompressed: its body no longer has the
+// Content-Encoding or the Content-Length it was sent with, so they are
+// removed, for the headers to describe the body the caller reads.
+func decodedBody(resp *http.Response) {
+    resp.Header.Del("Content-Encoding")
+    resp.Header.Del("Content-Length")
+    resp.ContentLength = -1
+    resp.Uncompressed = true
+}
+
+// decodingReader decompresses a response body. The decompressor is only set
+// up on the first read.
+type decodingReader struct {
+    body   io.ReadCloser
+    coding string
+    r      io.Reader
+    err    error
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+    if d.r == nil {
+        if d.err == nil {
+            d.r, d.err = newDecoder(d.coding, d.body)
+        }
+        if d.err != nil {
+            return 0, d.err
+        }
+    }
+    return d.r.Read(p)
+}
+
+func (d *decodingReader) Close() error {
+    return d.body.Close()
+}
+
+// protoConn rewrites the HTTP version in the first request line written to
+// it, which http.Request.Write always writes as HTTP/1.1.
+type protoConn struct {
+    net.Conn
+    proto   string
+    written bool
+}
+
+func (c *protoConn) Write(p []byte) (int, error) {
+    if c.written {
+        return c.Conn.Write(p)
+    }
+    c.written = true
+    i := bytes.Index(p, []byte(" HTTP/1.1\r\n"))
+    if i < 0 || bytes.IndexByte(p[0:i], '\n') >= 0 {
+        return c.Conn.Write(p)
+    }
+    line := make([]byte, 0, len(p)+len(c.proto))
+    line = append(line, p[0:i+1]...)
+    line = append(line, c.proto...)
+    line = append(line, p[i+9:]...)
+    if _, err := c.Conn.Write(line); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
+
+// connOptions are the settings new connections are made with.
+type connOptions struct {
+    tlsConfig *tls.Config
+    // resolve maps a "host" or "host:port" to the address to dial instead
+    resolve map[string]string
+    // dualStack dials IPv6 and IPv4 addresses concurrently
+    dualStack bool
+    dialer    Dialer
+    // envProxy uses the proxy environment variables
+    envProxy bool
+    // deadline, if set, limits dialing and all I/O on the connection
+    deadline time.Time
+    // firstByte, if set, limits the wait for the response to start
+    firstByte time.Duration
+    // readTimeout and writeTimeout, if set, limit each read and write
+    readTimeout  time.Duration
+    writeTimeout time.Duration
+    // absoluteURI sends the full URL in the request line
+    absoluteURI bool
+    // rawChunks decodes a chunked response with a chunkReader
+    rawChunks bool
+    // writeBuffer, if set, is the size of the buffer requests are written
+    // through
+    writeBuffer int
+    // readBuffer, if set, is the size of the buffer responses are read
+    // through
+    readBuffer int
+    // traffic, if set, counts the bytes sent and received on connections
+    traffic *traffic
+    // nagle leaves Nagle's algorithm on for TCP connections
+    nagle bool
+    // sessions, if set, caches TLS sessions for resuming unless tlsConfig
+    // has a cache of its own
+    sessions tls.ClientSessionCache
+}
+
+// dialAddr returns the address to dial for the host and port of a URL,
+// applying any resolve override for them.
+func (o *connOptions) dialAddr(host, port string) string {
+    addr := net.JoinHostPort(host, port)
+    if o == nil {
+        return addr
+    }
+    override, ok := o.resolve[strings.ToLower(addr)]
+    if !ok {
+        override, ok = o.resolve[strings.ToLower(host)]
+    }
+    if !ok {
+        return addr
+    }
+    if !hasPort(override) {
+        override = net.JoinHostPort(strings.Trim(override, "[]"), port)
+    }
+    return override
+}
+
+// Dialer makes the network connections requests are sent over, e.g. to go
+// through a SOCKS proxy, trace connections or connect in memory in tests.
+// *net.Dialer is a Dialer. For https, TLS is layered on top of the
+// connection it returns.
+type Dialer interface {
+    Dial(network, addr string) (net.Conn, error)
+}
+
+var defaultDialer Dialer = &net.Dialer{}
+
+// dial connects to addr over TCP, by the deadline of the options if any,
+// which is then set on the connection.
+func (o *connOptions) dial(addr string) (net.Conn, error) {
+    dialer := defaultDialer
+    var deadline time.Time
+    if o != nil {
+        if o.dialer != nil {
+            dialer = o.dialer
+        }
+        deadline = o.deadline
+    }
+    ctx := context.Background()
+    if !deadline.IsZero() {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithDeadline(ctx, deadline)
+        defer cancel()
+    }
+    var conn net.Conn
+    var err error
+    if o != nil && o.dualStack {
+        conn, err = dialDualStack(ctx, contextDial(dialer), addr)
+    } else {
+        conn, err = contextDial(dialer)(ctx, addr)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !deadline.IsZero() {
+        conn.SetDeadline(deadline)
+    }
+    if tcp, ok := conn.(*net.TCPConn); ok {
+        tcp.SetNoDelay(o == nil || !o.nagle)
+    }
+    if o != nil && o.traffic != nil {
+        conn = &countingConn{Conn: conn, traffic: o.traffic}
+    }
+    return conn, nil
+}
+
+// contextDial returns a function dialing TCP connections with dialer that
+// gives up when its context is done. Dials by a Dialer without a
+// DialContext method are left to finish, but their result is dropped.
+func contextDial(dialer Dialer) func(ctx context.Context, addr string) (net.Conn, error) {
+    if d, ok := dialer.(interface {
+        DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+    }); ok {
+        return func(ctx context.Context, addr string) (net.Conn, error) {
+            return d.DialContext(ctx, "tcp", addr)
+        }
+    }
+    return func(ctx context.Context, addr string) (net.Conn, error) {
+        type result struct {
+            conn net.Conn
+            err  error
+        }
+        done := make(chan result, 1)
+        go func() {
+            conn, err := dialer.Dial("tcp", addr)
+            done <- result{conn, err}
+        }()
+        select {
+        case r := <-done:
+            return r.conn, r.err
+        case <-ctx.Done():
+            go func() {
+                if r := <-done; r.conn != nil {
+                    r.conn.Close()
+                }
+            }()
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// happyEyeballsDelay is how long a dual-stack dial waits on the first
+// address family before also trying the other.
+var happyEyeballsDelay = 300 * time.Millisecond
+
+// dialDualStack resolves the host of addr and dials its IPv6 and IPv4
+// addresses concurrently, RFC 6555 style: the family of the first address
+// gets a head start of happyEyeballsDelay, and the first connection made
+// wins.
+func dialDualStack(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+    if err != nil {
+        return nil, err
+    }
+    var primary, fallback []string
+    for _, ip := range ips {
+        a := net.JoinHostPort(ip.String(), port)
+        if (ip.To4() == nil) == (ips[0].To4() == nil) {
+            primary = append(primary, a)
+        } else {
+            fallback = append(fallback, a)
+        }
+    }
+    return dialRace(ctx, dial, primary, fallback, happyEyeballsDelay)
+}
+
+// dialRace dials the primary addresses one after another, and after delay,
+// or as soon as they have all failed, the fallback addresses alongside. The
+// first connection made is returned, and the other dial is canceled.
+func dialRace(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), primary, fallback []string, delay time.Duration) (net.Conn, error) {
+    type result struct {
+        conn net.Conn
+        err  error
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    results := make(chan result, 2)
+    dialSerial := func(addrs []string) {
+        for i, a := range addrs {
+            conn, err := dial(ctx, a)
+            if err == nil || i == len(addrs)-1 {
+                results <- result{conn, err}
+                return
+            }
+        }
+    }
+
+    go dialSerial(primary)
+    racing := 1
+    var timer <-chan time.Time
+    if len(fallback) > 0 {
+        timer = time.After(delay)
+    }
+    var firstErr error
+    for racing > 0 {
+        select {
+        case <-timer:
+            timer = nil
+            go dialSerial(fallback)
+            racing++
+        case r := <-results:
+            racing--
+            if r.err == nil {
+                if racing > 0 {
+                    // the other dial is canceled, but may have connected
+                    go func() {
+                        if r := <-results; r.conn != nil {
+                            r.conn.Close()
+                        }
+                    }()
+                }
+                return r.conn, nil
+            }
+            if firstErr == nil {
+                firstErr = r.err
+            }
+            if timer != nil {
+                timer = nil
+                go dialSerial(fallback)
+                racing++
+            }
+        }
+    }
+    return nil, firstErr
+}
+
+// newConn connects to the host of url, through proxy if it isn't nil.
+func newConn(url *url.URL, proxy *url.URL, opts *connOptions) (net.Conn, error) {
+    //just set the default scheme to http
+    if url.Scheme == "" {
+        url.Scheme = "http"
+    }
+    host, port := url.Hostname(), url.Port()
+    if port == "" {
+        port = "80"
+        if url.Scheme == "https" {
+            port = "443"
+        }
+    }
+    addr := opts.dialAddr(host, port)
+    if proxy != nil && url.Scheme == "http" {
+        // the proxy takes the host to connect to from the request line, and
+        // sends it on as the Host header, so the two can't be told apart
+        if addr != net.JoinHostPort(host, port) {
+            return nil, fmt.Errorf("httplib: can't resolve %s to %s through the http proxy %s", host, addr, proxy.Host)
+        }
+        return opts.dial(proxyAddr(proxy))
+    }
+    if proxy != nil {
+        conn, err := opts.dial(proxyAddr(proxy))
+        if err != nil {
+            return nil, err
+        }
+        if err := connectTunnel(conn, proxy, addr); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        return tlsHandshake(conn, host, opts)
+    }
+    conn, err := opts.dial(addr)
+    if err != nil || url.Scheme == "http" {
+        return conn, err
+    }
+    return tlsHandshake(conn, host, opts)
+}
+
+// tlsHandshake starts TLS over conn, to host, and verifies the server is
+// host, closing conn if anything fails.
+func tlsHandshake(conn net.Conn, host string, opts *connOptions) (net.Conn, error) {
+    var config *tls.Config
+    if opts != nil {
+        config = opts.tlsConfig
+    }
+    // the server name would otherwise be taken from the address dialed,
+    // which isn't the host when resolution is overridden or a proxy is used
+    setName := config == nil || config.ServerName == ""
+    setCache := opts != nil && opts.sessions != nil && (config == nil || config.ClientSessionCache == nil)
+    if setName || setCache {
+        if config == nil {
+            config = &tls.Config{}
+        } else {
+            config = config.Clone()
+        }
+        if setName {
+            config.ServerName = host
+        }
+        if setCache {
+            config.ClientSessionCache = opts.sessions
+        }
+    }
+    tlsConn := tls.Client(conn, config)
+    if err := tlsConn.Handshake(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    if config.InsecureSkipVerify {
+        return tlsConn, nil
+    }
+    if err := tlsConn.VerifyHostname(config.ServerName); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return tlsConn, nil
+}
+
+// parseURL parses rawUrl, keeping any escaping of its path as given so the
+// server receives exactly that path. The fragment is parsed but never sent,
+// as the request URI leaves it out.
+func parseURL(rawUrl string) (*url.URL, error) {
+    //just set the default scheme to http
+    if !strings.Contains(rawUrl, "://") {
+        rawUrl = "http://" + rawUrl
+    }
+    return url.Parse(rawUrl)
+}
+
+// persistConn is a client connection along with the network connection it
+// runs over.
+type persistConn struct {
+    *httputil.ClientConn
+    raw net.Conn
+    // key is the Client pool the connection belongs in, "" if none
+    key string
+    // broken is set once the connection can't be used for another request
+    broken    bool
+    deadlines *deadlineConn
+    // proxy is the http proxy that requests are sent to, nil when the
+    // connection goes to the server or through a CONNECT tunnel
+    proxy *url.URL
+    // rawChunks reads the next response with readRawChunks
+    rawChunks bool
+    // buffer is the write buffer of the connection, if it has one
+    buffer *bufferedConn
+}
+
+func dial(url *url.URL, req *http.Request, opts *connOptions) (*persistConn, error) {
+    proxy, err := opts.proxy(url)
+    if err != nil {
+        return nil, err
+    }
+    c, err := newConn(url, proxy, opts)
+    if err != nil {
+        return nil, err
+    }
+    raw := c
+    deadlines := &deadlineConn{Conn: c}
+    c = deadlines
+    if req.ProtoMajor != 0 && (req.ProtoMajor != 1 || req.ProtoMinor != 1) {
+        c = &protoConn{Conn: c, proto: req.Proto}
+    }
+    var buffer *bufferedConn
+    if opts != nil && opts.writeBuffer > 0 {
+        buffer = &bufferedConn{Conn: c, w: bufio.NewWriterSize(c, opts.writeBuffer)}
+        c = buffer
+    }
+    var r *bufio.Reader
+    if opts != nil && opts.readBuffer > 0 {
+        r = bufio.NewReaderSize(c, opts.readBuffer)
+    }
+    pc := &persistConn{ClientConn: httputil.NewClientConn(c, r), raw: raw, deadlines: deadlines, buffer: buffer}
+    if url.Scheme == "http" {
+        pc.proxy = proxy
+    }
+    pc.setOptions(opts)
+    return pc, nil
+}
+
+// setOptions applies the deadline, timeouts and other per-request settings
+// of opts to the next request on the connection.
+func (pc *persistConn) setOptions(opts *connOptions) {
+    if opts == nil {
+        opts = &connOptions{}
+    }
+    pc.rawChunks = opts.rawChunks
+    pc.raw.SetDeadline(opts.deadline)
+    pc.deadlines.deadline = opts.deadline
+    pc.deadlines.firstByte = opts.firstByte
+    pc.deadlines.readTimeout = opts.readTimeout
+    pc.deadlines.writeTimeout = opts.writeTimeout
+    pc.deadlines.waiting = opts.firstByte > 0
+}
+
+// deadlineConn backs the timeouts of a request with socket deadlines. The
+// deadline, set on the connection directly, limits the whole request. On
+// top of it, reading the response fails with ErrFirstByteTimeout if its
+// first byte takes longer than firstByte to arrive once reading starts,
+// which is after the request has been written, and each read or write fails
+// if it makes no progress within readTimeout or writeTimeout.
+type deadlineConn struct {
+    net.Conn
+    deadline     time.Time
+    firstByte    time.Duration
+    readTimeout  time.Duration
+    writeTimeout time.Duration
+    // waiting is set until the first byte of the response arrives
+    waiting bool
+}
+
+// within returns the time d from now, or the deadline if that is sooner.
+func (c *deadlineConn) within(d time.Duration) time.Time {
+    t := time.Now().Add(d)
+    if !c.deadline.IsZero() && c.deadline.Before(t) {
+        return c.deadline
+    }
+    return t
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+    timeout := c.readTimeout
+    if c.waiting {
+        timeout = c.firstByte
+    }
+    if timeout > 0 {
+        c.Conn.SetReadDeadline(c.within(timeout))
+    }
+    n, err := c.Conn.Read(p)
+    if c.waiting {
+        if n > 0 {
+            c.waiting = false
+            if c.readTimeout == 0 {
+                c.Conn.SetReadDeadline(c.deadline)
+            }
+        } else if ne, ok := err.(net.Error); ok && ne.Timeout() && (c.deadline.IsZero() || time.Now().Before(c.deadline)) {
+            return n, ErrFirstByteTimeout
+        }
+    }
+    return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+    if c.writeTimeout > 0 {
+        c.Conn.SetWriteDeadline(c.within(c.writeTimeout))
+    }
+    return c.Conn.Write(p)
+}
+
+// bufferedConn buffers the writes to a connection until they are flushed.
+type bufferedConn struct {
+    net.Conn
+    w *bufio.Writer
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+    return c.w.Write(p)
+}
+
+// WriteByte makes net/http write requests straight to the buffer, rather
+// than through a 4KB bufio.Writer of its own.
+func (c *bufferedConn) WriteByte(b byte) error {
+    return c.w.WriteByte(b)
+}
+
+// write writes req to the connection, flushing the write buffer after it.
+func (pc *persistConn) write(req *http.Request) error {
+    err := pc.Write(req)
+    if err == nil && pc.buffer != nil {
+        err = pc.buffer.w.Flush()
+    }
+    return err
+}
+
+// roundTrip writes req to the connection and reads its response.
+func (pc *persistConn) roundTrip(req *http.Request) (*http.Response, error) {
+    out := req
+    if pc.proxy != nil {
+        out = proxyRequest(req, pc.proxy)
+    }
+    if pc.rawChunks {
+        return pc.readRawChunks(req, out)
+    }
+    var resp *http.Response
+    err := pc.write(out)
+    if err == nil {
+        resp, err = pc.Read(out)
+    }
+    // Skip interim 1xx responses, such as 100 Continue, to get to the final
+    // response. 101 Switching Protocols is final, the connection changes
+    // protocol after it.
+    for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != 101 {
+        c, r := pc.Hijack()
+        pc.ClientConn = httputil.NewClientConn(c, r)
+        resp, err = http.ReadResponse(r, out)
+    }
+    if err != nil {
+        // ErrPersistEOF only means the connection can't be reused, e.g. the
+        // body of an HTTP/1.0 response without Content-Length, which runs
+        // until the server closes the connection. The response is valid.
+        if err != httputil.ErrPersistEOF {
+            return nil, err
+        }
+        pc.broken = true
+    }
+    return pc.finish(req, resp), nil
+}
+
+// finish completes resp, the response to req.
+func (pc *persistConn) finish(req *http.Request, resp *http.Response) *http.Response {
+    if req.Close || resp.Close {
+        pc.broken = true
+    }
+    resp.Request = req
+    if tlsConn, ok := pc.raw.(*tls.Conn); ok {
+        state := tlsConn.ConnectionState()
+        resp.TLS = &state
+    }
+    return resp
+}
+
+// readRawChunks writes out, the request req as sent, and reads its response
+// like roundTrip, but decodes a chunked body itself, with a chunkReader,
+// rather than leave it to net/http, which drops chunk extensions. Only the
+// header of the response is read by net/http, as that of a response to a
+// HEAD request, leaving the body on the connection.
+func (pc *persistConn) readRawChunks(req, out *http.Request) (*http.Response, error) {
+    if err := pc.write(out); err != nil {
+        return nil, err
+    }
+    c, r := pc.Hijack()
+    pc.ClientConn = httputil.NewClientConn(c, r)
+    head := &http.Request{Method: "HEAD"}
+    resp, err := http.ReadResponse(r, head)
+    for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != 101 {
+        resp, err = http.ReadResponse(r, head)
+    }
+    if err != nil {
+        return nil, err
+    }
+    switch {
+    case out.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304:
+        resp.Body = http.NoBody
+    case len(resp.TransferEncoding) > 0:
+        resp.Body = &rawBody{Reader: &chunkReader{r: r, resp: resp}, pc: pc}
+        resp.ContentLength = -1
+    case resp.ContentLength >= 0:
+        resp.Body = &rawBody{Reader: io.LimitReader(r, resp.ContentLength), pc: pc}
+    default:
+        // the body runs until the server closes the connection
+        resp.Body = &rawBody{Reader: r, pc: pc}
+        pc.broken = true
+    }
+    return pc.finish(req, resp), nil
+}
+
+// rawBody is a body read by readRawChunks straight off the connection.
+// Closing it before the end closes the connection, which is left in the
+// middle of the response.
+type rawBody struct {
+    io.Reader
+    pc  *persistConn
+    eof bool
+}
+
+func (r *rawBody) Read(p []byte) (int, error) {
+    n, err := r.Reader.Read(p)
+    if err == io.EOF {
+        r.eof = true
+    }
+    return n, err
+}
+
+func (r *rawBody) Close() error {
+    if r.eof {
+        return nil
+    }
+    r.pc.broken = true
+    return r.pc.Close()
+}
+
+// Chunk is a chunk of a chunked response body, as read with RawChunks.
+type Chunk struct {
+    // Size is the length of the data of the chunk, 0 for the last chunk
+    Size int64
+    // Extensions are the chunk extensions, the rest of the chunk line after
+    // the size, as sent but for the leading ';' and surrounding whitespace
+    Extensions string
+}
+
+// maxChunkLine limits the length of a chunk line, as net/http does.
+const maxChunkLine = 4096
+
+// chunkReader decodes a chunked body, keeping the size and extensions of
+// each chunk, and sets the trailer of resp once it reaches the end.
+type chunkReader struct {
+    r      *bufio.Reader
+    resp   *http.Response
+    chunks []Chunk
+    // n is what is left of the data of the current chunk
+    n int64
+    // crlf is set when the CRLF after the data of a chunk is still to read
+    crlf bool
+    err  error
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+    if cr.err != nil {
+        return 0, cr.err
+    }
+    if cr.n == 0 {
+        if cr.err = cr.nextChunk(); cr.err != nil {
+            return 0, cr.err
+        }
+    }
+    if int64(len(p)) > cr.n {
+        p = p[:cr.n]
+    }
+    n, err := cr.r.Read(p)
+    cr.n -= int64(n)
+    cr.crlf = cr.n == 0
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    cr.err = err
+    return n, err
+}
+
+// nextChunk reads the line of the next chunk, and the trailer after the
+// last one, which ends the body with io.EOF.
+func (cr *chunkReader) nextChunk() error {
+    if cr.crlf {
+        line, err := cr.readLine()
+        if err != nil {
+            return err
+        }
+        if len(line) != 0 {
+            return errors.New("httplib: malformed chunked encoding")
+        }
+        cr.crlf = false
+    }
+    for {
+        line, err := cr.readLine()
+        if err != nil {
+            return err
+        }
+        var chunk Chunk
+        size := line
+        if i := strings.IndexByte(line, ';'); i >= 0 {
+            size = line[:i]
+            chunk.Extensions = strings.TrimSpace(line[i+1:])
+        }
+        chunk.Size, err = strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+        if err != nil || chunk.Size < 0 {
+            return errors.New("httplib: malformed chunk size " + strconv.Quote(size))
+        }
+        cr.chunks = append(cr.chunks, chunk)
+        if chunk.Size > 0 {
+            cr.n = chunk.Size
+            return nil
+        }
+        trailer, err := textproto.NewReader(cr.r).ReadMIMEHeader()
+        if err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return err
+        }
+        if cr.resp.Trailer == nil {
+            cr.resp.Trailer = http.Header{}
+        }
+        for key, values := range trailer {
+            cr.resp.Trailer[key] = values
+        }
+        return io.EOF
+    }
+}
+
+// readLine reads a line of the chunked encoding, without its CRLF.
+func (cr *chunkReader) readLine() (string, error) {
+    line, err := cr.r.ReadSlice('\n')
+    if err == bufio.ErrBufferFull || len(line) > maxChunkLine {
+        return "", errors.New("httplib: chunk line too long")
+    }
+    if err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return "", err
+    }
+    return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Close closes the network connection, which also interrupts a request in
+// progress on it.
+func (pc *persistConn) Close() error {
+    return pc.raw.Close()
+}
+
+func debugRequest(req *http.Request) {
+    if debugprint {
+        dump, err := httputil.DumpRequest(req, true)
+        if err != nil {
+            println(err.Error())
+        }
+        print(string(dump))
+    }
+}
+
+func getResponse(rawUrl string, req *http.Request, opts *connOptions) (*persistConn, *http.Response, error) {
+    url, err := parseURL(rawUrl)
+    if err != nil {
+        return nil, nil, err
+    }
+    if opts != nil && opts.absoluteURI {
+        absoluteForm(url)
+    }
+    req.URL = url
+    debugRequest(req)
+
+    conn, err := dial(url, req, opts)
+    if err != nil {
+        println(err.Error())
+        return nil, nil, err
+    }
+    resp, err := conn.roundTrip(req)
+    if err != nil {
+        conn.Close()
+        return nil, nil, err
+    }
+    return conn, resp, nil
+}
+
+// Do sends an existing request over a new connection and returns the
+// response. The connection is closed when the response body is closed.
+func Do(req *http.Request) (*http.Response, error) {
+    conn, resp, err := getResponse(req.URL.String(), req, nil)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Body == nil {
+        conn.Close()
+        return resp, nil
+    }
+    resp.Body = connCloser{resp.Body, conn}
+    return resp, nil
+}
+
+// NewRequest returns a builder for a request with any method, such as
+// PATCH or the WebDAV methods PROPFIND, MKCOL, COPY and MOVE.
+func NewRequest(method, url string) *HttpRequestBuilder {
+    var req http.Request
+    req.Method = method
+    req.Header = http.Header{}
+    req.Header.Set("User-Agent", defaultUserAgent)
+    return &HttpRequestBuilder{url: url, req: &req, params: map[string][]string{}, abort: &abortState{}}
+}
+
+// Download saves the resource at url to destPath, verifying its SHA-256
+// checksum, given in hex, as it is written. The data is written to destPath
+// + ".part", which is renamed to destPath only once the checksum matches and
+// removed on a mismatch or an error response. If the transfer itself is cut
+// short the partial file is kept, and the next Download of it resumes with a
+// Range request.
+func Download(url, destPath, expectedSHA256 string) error {
+    tmp := destPath + ".part"
+    f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    h := sha256.New()
+    // hash whatever an earlier attempt already wrote
+    offset, err := io.Copy(h, f)
+    if err != nil {
+        return err
+    }
+
+    // a compressed transfer would make the offset of a resumed download
+    // meaningless, as ranges apply to the compressed bytes
+    b := Get(url).DisableCompression()
+    defer b.Close()
+    if offset > 0 {
+        b.Header("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+    resp, err := b.AsResponse()
+    if err != nil {
+        return err
+    }
+    switch {
+    case offset > 0 && resp.StatusCode == 206:
+        if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+            os.Remove(tmp)
+            return fmt.Errorf("httplib: download of %s resumed at the wrong offset", url)
+        }
+    case offset > 0 && resp.StatusCode == 416:
+        // the earlier attempt already got everything
+        resp.Body = nil
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        // a fresh download, or the server ignored the Range
+        if err := f.Truncate(0); err != nil {
+            return err
+        }
+        if _, err := f.Seek(0, 0); err != nil {
+            return err
+        }
+        h.Reset()
+    default:
+        os.Remove(tmp)
+        return fmt.Errorf("httplib: download of %s failed: %s", url, resp.Status)
+    }
+    if resp.Body != nil {
+        if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+            return err
+        }
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+
+    sum := hex.EncodeToString(h.Sum(nil))
+    if sum != strings.ToLower(expectedSHA256) {
+        os.Remove(tmp)
+        return fmt.Errorf("httplib: checksum mismatch for %s: expected %s, got %s", url, expectedSHA256, sum)
+    }
+    return os.Rename(tmp, destPath)
+}
+
+// Ping checks that the server at url is reachable, sending it a HEAD
+// request and returning nil if it answers within timeout, or no limit if
+// timeout is 0. Any response counts, even one with an error status, as it
+// shows that the server is up; the error returned is from connecting to it
+// or reading the response. It is meant for readiness checks at startup.
+func Ping(url string, timeout time.Duration) error {
+    b := NewRequest("HEAD", url).Timeout(timeout)
+    defer b.Close()
+    _, err := b.AsResponse()
+    return err
+}
+
+func Get(url string) *HttpRequestBuilder {
+    return NewRequest("GET", url)
+}
+
+func Post(url string) *HttpRequestBuilder {
+    return NewRequest("POST", url)
+}
+
+func Put(url string) *HttpRequestBuilder {
+    return NewRequest("PUT", url)
+}
+
+func Delete(url string) *HttpRequestBuilder {
+    return NewRequest("DELETE", url)
+}
+
+type HttpRequestBuilder struct {
+    url    string
+    req    *http.Request
+    client *Client
+    // clientConn is guarded by abort.mu for Abort
+    clientConn     *persistConn
+    abort          *abortState
+    params         url.Values
+    arrayStyle     ArrayStyle
+    rawQuery       string
+    body           []byte
+    bodyFile       string
+    files          []formFile
+    uploadProgress func(sent, total int64)
+    bodyReader     io.Reader
+    stream         *streamBody
+    bufferBody     bool
+    resp           *http.Response
+    history        []*http.Response
+    maxRedirects   int
+    metaRefresh    bool
+    awsSigner      *awsSigner
+    counter        *countingReader
+    pathRewrite    func(path string) string
+    dialControl    func(network, address string, c syscall.RawConn) error
+    nagle          bool
+    expectType     string
+    checkStatus    bool
+    allowShort     bool
+    validators     []func(*http.Response) error
+    redact         []string
+    sent           *http.Request
+    errorTarget    interface{}
+    compressAbove  int
+    // gzBody is the compressed body being sent, if it is
+    gzBody         []byte
+    maxAttempts    int
+    attempts       int
+    retries        int
+    retryBackoff   time.Duration
+    retryIf        func(*http.Response, error) bool
+    maxRetryWait   time.Duration
+    noDowngrade    bool
+    maxRate        int64
+    maxBodySize    int64
+    decompress     bool
+    toFile         bool
+    ranges         [][2]int64
+    tlsConfig      *tls.Config
+    pins           []string
+    minTLS         uint16
+    ciphers        []uint16
+    serverName     string
+    resolve        map[string]string
+    dualStack      bool
+    dialer         Dialer
+    transport      http.RoundTripper
+    socks          *socks5Dialer
+    envProxy       bool
+    timeout        time.Duration
+    firstByte      time.Duration
+    readTimeout    time.Duration
+    writeTimeout   time.Duration
+    maxPages       int
+    noGzip         bool
+    referer        string
+    overrideHeader string
+    absoluteURI    bool
+    rawChunks      bool
+    // chunks is the chunkReader of the response, with RawChunks
+    chunks         *chunkReader
+    encodingAdded  bool
+    rawBody        bool
+    deadline       time.Time
+    teeReq         io.Writer
+    teeResp        io.Writer
+    refreshToken   func() (string, error)
+    rawDump        bool
+    useNetrc       bool
+    idHeader       string
+    newID          func() string
+    err            error
+}
+
+// prepare folds the params into the request, either as the query string
+// for GET or as a form body for POST, and returns the final url.
+func (b *HttpRequestBuilder) prepare() string {
+    var paramBody string
+    // with files the params go in the multipart body instead
+    if b.params != nil && len(b.params) > 0 && len(b.files) == 0 {
+        var buf bytes.Buffer
+        for _, pair := range paramPairs(b.params, b.arrayStyle) {
+            buf.WriteString(url.QueryEscape(pair[0]))
+            buf.WriteByte('=')
+            buf.WriteString(url.QueryEscape(pair[1]))
+            buf.WriteByte('&')
+        }
+        paramBody = buf.String()
+        paramBody = paramBody[0 : len(paramBody)-1]
+    }
+    rawUrl := b.url
+    if b.req.Method == "GET" && len(paramBody) > 0 {
+        rawUrl = appendQuery(rawUrl, paramBody)
+    } else if b.req.Method == "POST" && b.body == nil && b.bodyReader == nil && len(paramBody) > 0 {
+        b.Header("Content-Type", "application/x-www-form-urlencoded")
+        b.body = []byte(paramBody)
+        b.req.ContentLength = int64(len(paramBody))
+    }
+    if len(b.rawQuery) > 0 {
+        rawUrl = appendQuery(rawUrl, b.rawQuery)
+    }
+    return rawUrl
+}
+
+// appendQuery adds query to the query string of rawUrl, which must go
+// before any fragment.
+func appendQuery(rawUrl, query string) string {
+    var fragment string
+    if i := strings.Index(rawUrl, "#"); i != -1 {
+        rawUrl, fragment = rawUrl[0:i], rawUrl[i:]
+    }
+    if strings.Index(rawUrl, "?") != -1 {
+        return rawUrl + "&" + query + fragment
+    }
+    return rawUrl + "?" + query + fragment
+}
+
+func (b *HttpRequestBuilder) shouldRetry(resp *http.Response, err error) bool {
+    if b.maxAttempts > 0 && b.attempts >= b.maxAttempts || err == ErrAborted {
+        return false
+    }
+    if b.retryIf != nil {
+        return b.retryIf(resp, err)
+    }
+    return DefaultRetryIf(resp, err)
+}
+
+// retryDelay returns how long to wait before the given retry, which is the
+// Retry-After of a 429 or 503 response, up to MaxRetryAfter, or otherwise the
+// backoff.
+func (b *HttpRequestBuilder) retryDelay(retry int, resp *http.Response) time.Duration {
+    if resp != nil && (resp.StatusCode == 429 || resp.StatusCode == 503) {
+        if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+            max := b.maxRetryWait
+            if max == 0 {
+                max = defaultMaxRetryAfter
+            }
+            if d > max {
+                d = max
+            }
+            return d
+        }
+    }
+    return b.retryBackoff << uint(retry)
+}
+
+// retryAfter parses a Retry-After value, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+    if value == "" {
+        return 0, false
+    }
+    if secs, err := strconv.Atoi(value); err == nil {
+        if secs < 0 {
+            return 0, false
+        }
+        return time.Duration(secs) * time.Second, true
+    }
+    t, err := http.ParseTime(value)
+    if err != nil {
+        return 0, false
+    }
+    d := t.Sub(time.Now())
+    if d < 0 {
+        d = 0
+    }
+    return d, true
+}
+
+// DefaultRetryIf is the retry predicate used unless RetryIf is set. It
+// retries network errors and 429 Too Many Requests, 502 Bad Gateway, 503
+// Service Unavailable and 504 Gateway Timeout responses.
+func DefaultRetryIf(resp *http.Response, err error) bool {
+    if err != nil {
+        return true
+    }
+    switch resp.StatusCode {
+    case 429, 502, 503, 504:
+        return true
+    }
+    return false
+}
+
+// openBody readies the request body to be sent from the start, so that it
+// can be sent again after a redirect or retry.
+func (b *HttpRequestBuilder) openBody() error {
+    if err := b.resetBody(); err != nil {
+        return err
+    }
+    if b.teeReq != nil && b.req.Body != nil {
+        b.req.Body = readCloser{io.TeeReader(b.req.Body, b.teeReq), b.req.Body}
+    }
+    return nil
+}
+
+// resetBody points the request body at the start of the data set by Body,
+// BodyFile or File.
+func (b *HttpRequestBuilder) resetBody() error {
+    b.stream = nil
+    if b.gzBody != nil {
+        b.req.Header.Del("Content-Encoding")
+        b.gzBody = nil
+    }
+    if b.bodyReader != nil && (b.bufferBody || b.compressAbove > 0) {
+        r := b.bodyReader
+        if b.maxBodySize > 0 {
+            r = io.LimitReader(r, b.maxBodySize+1)
+        }
+        data, err := ioutil.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        if b.maxBodySize > 0 && int64(len(data)) > b.maxBodySize {
+            return ErrBodyTooLarge
+        }
+        b.Body(data)
+    }
+    if b.bodyFile != "" {
+        f, err := os.Open(b.bodyFile)
+        if err != nil {
+            return err
+        }
+        fi, err := f.Stat()
+        if err != nil {
+            f.Close()
+            return err
+        }
+        b.req.Body = f
+        b.req.ContentLength = fi.Size()
+    } else if b.body != nil && b.compressAbove > 0 && len(b.body) > b.compressAbove &&
+        b.req.Header.Get("Content-Encoding") == "" {
+        var buf bytes.Buffer
+        zw := gzip.NewWriter(&buf)
+        zw.Write(b.body)
+        if err := zw.Close(); err != nil {
+            return err
+        }
+        b.gzBody = buf.Bytes()
+        b.req.Header.Set("Content-Encoding", "gzip")
+        b.req.Body = ioutil.NopCloser(bytes.NewReader(b.gzBody))
+        b.req.ContentLength = int64(len(b.gzBody))
+    } else if b.body != nil {
+        b.req.Body = getNopCloser(bytes.NewBuffer(b.body))
+        b.req.ContentLength = int64(len(b.body))
+    } else if b.bodyReader != nil {
+        rc, ok := b.bodyReader.(io.ReadCloser)
+        if !ok {
+            rc = ioutil.NopCloser(b.bodyReader)
+        }
+        b.stream = &streamBody{ReadCloser: rc}
+        b.req.Body = b.stream
+    } else if len(b.files) > 0 {
+        form, err := newMultipartBody(paramPairs(b.params, b.arrayStyle), b.files)
+        if err != nil {
+            return err
+        }
+        b.req.Header.Set("Content-Type", form.contentType)
+        b.req.Body = form.open()
+        if b.uploadProgress != nil {
+            b.req.Body = &progressReader{ReadCloser: b.req.Body, total: form.length, cb: b.uploadProgress}
+        }
+        b.req.ContentLength = form.length
+    }
+    return nil
+}
+
+// streamBody is a request body from an io.Reader, which can't be sent again
+// once it has been read from.
+type streamBody struct {
+    io.ReadCloser
+    read bool
+}
+
+func (s *streamBody) Read(p []byte) (int, error) {
+    s.read = true
+    return s.ReadCloser.Read(p)
+}
+
+// canResend reports whether the request can be sent again from the start:
+// its body can be, unless it streams from an io.Reader that has been read.
+func (b *HttpRequestBuilder) canResend() bool {
+    return b.stream == nil || !b.stream.read
+}
+
+// isIdempotent reports whether sending a request with method twice has the
+// same effect as sending it once, so that it is safe to resend one that may
+// have reached the server.
+func isIdempotent(method string) bool {
+    switch method {
+    case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+        return true
+    }
+    return false
+}
+
+// credentialHeaders are the headers not sent on to another scheme or host
+// by a redirect or NextPage.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+func isRedirect(status int) bool {
+    switch status {
+    case 301, 302, 303, 307, 308:
+        return true
+    }
+    return false
+}
+
+func (b *HttpRequestBuilder) getResponse() (*http.Response, error) {
+    if b.err != nil {
+        return nil, b.err
+    }
+    rawUrl := b.prepare()
+    if err := b.setHeaders(rawUrl); err != nil {
+        return nil, err
+    }
+    b.attempts = 0
+    resp, err := b.send(rawUrl)
+    for retry := 0; retry < b.retries && b.canResend() && b.shouldRetry(resp, err); retry++ {
+        b.Close()
+        time.Sleep(b.retryDelay(retry, resp))
+        resp, err = b.send(rawUrl)
+    }
+    if err == nil && resp.StatusCode == 401 && b.refreshToken != nil && b.canResend() {
+        b.Close()
+        var token string
+        if token, err = b.refreshToken(); err != nil {
+            return nil, err
+        }
+        b.Header("Authorization", "Bearer "+token)
+        resp, err = b.send(rawUrl)
+    }
+    if err != nil {
+        return nil, err
+    }
+    b.wrapBody(resp)
+    if b.checkStatus && resp.StatusCode >= 400 {
+        return nil, b.statusError(resp)
+    }
+    if b.expectType != "" && hasBody(resp) {
+        if err := b.checkContentType(resp); err != nil {
+            return nil, err
+        }
+    }
+    for _, validate := range b.validators {
+        if err := validate(resp); err != nil {
+            b.Close()
+            return nil, err
+        }
+    }
+    return resp, nil
+}
+
+// snippetSize is how much of an unexpected response body goes in an error.
+const snippetSize = 200
+
+// statusError reads the body of resp, an error response, into a
+// StatusError, decoding it into the value given to OnErrorDecode, if any.
+func (b *HttpRequestBuilder) statusError(resp *http.Response) error {
+    var data []byte
+    if resp.Body != nil {
+        var err error
+        if data, err = b.readAll(resp); err != nil {
+            return err
+        }
+    }
+    e := newStatusError(resp, data)
+    if b.errorTarget != nil && json.Unmarshal(data, b.errorTarget) == nil {
+        e.Detail = b.errorTarget
+    }
+    return e
+}
+
+// checkContentType fails with the start of the body if the Content-Type of
+// resp isn't the one set with ExpectContentType.
+func (b *HttpRequestBuilder) checkContentType(resp *http.Response) error {
+    contentType := resp.Header.Get("Content-Type")
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+    }
+    if mediaType != "" && strings.HasPrefix(mediaType, strings.ToLower(b.expectType)) {
+        return nil
+    }
+    snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, snippetSize))
+    b.Close()
+    return fmt.Errorf("httplib: expected Content-Type %s, got %q with body %q", b.expectType, contentType, snippet)
+}
+
+// setHeaders adds the headers that depend on the settings of the builder
+// to the request to rawUrl.
+func (b *HttpRequestBuilder) setHeaders(rawUrl string) error {
+    if b.useNetrc && b.req.Header.Get("Authorization") == "" {
+        if err := b.applyNetrc(rawUrl); err != nil {
+            return err
+        }
+    }
+    if b.idHeader != "" && b.req.Header.Get(b.idHeader) == "" {
+        b.req.Header.Set(b.idHeader, b.newID())
+    }
+    if !b.encodingAdded && !b.noGzip && !b.toFile && b.req.Method != "HEAD" &&
+        b.req.Header.Get("Accept-Encoding") == "" && b.req.Header.Get("Range") == "" {
+        b.req.Header.Set("Accept-Encoding", "gzip, deflate")
+        b.encodingAdded = true
+    }
+    return nil
+}
+
+// newRequest readies the request to be sent once as it is, without the
+// retries and redirects of getResponse, and returns its URL.
+func (b *HttpRequestBuilder) newRequest() (*url.URL, error) {
+    if b.err != nil {
+        return nil, b.err
+    }
+    rawUrl := b.prepare()
+    if err := b.setHeaders(rawUrl); err != nil {
+        return nil, err
+    }
+    u, err := parseURL(rawUrl)
+    if err != nil {
+        return nil, err
+    }
+    if b.absoluteURI {
+        absoluteForm(u)
+    }
+    b.req.URL = u
+    if err := b.openBody(); err != nil {
+        return nil, err
+    }
+    if b.awsSigner != nil {
+        if err := b.signAWS(u); err != nil {
+            return nil, err
+        }
+    }
+    return u, nil
+}
+
+// wrapBody sets up the reading of the response body: counting, throttling,
+// decompressing and copying it as the builder asks.
+func (b *HttpRequestBuilder) wrapBody(resp *http.Response) {
+    b.counter = nil
+    b.chunks = nil
+    if raw, ok := resp.Body.(*rawBody); ok {
+        b.chunks, _ = raw.Reader.(*chunkReader)
+    }
+    if hasBody(resp) && resp.ContentLength > 0 {
+        resp.Body = &lengthChecker{ReadCloser: resp.Body, length: resp.ContentLength, allowShort: b.allowShort}
+    }
+    if resp.Body != nil {
+        b.counter = &countingReader{ReadCloser: &abortableBody{ReadCloser: resp.Body, b: b}}
+        resp.Body = b.counter
+    }
+    if b.maxRate > 0 && resp.Body != nil {
+        resp.Body = newThrottledReader(resp.Body, b.maxRate)
+    }
+    if coding := contentCoding(resp); b.encodingAdded && !b.rawBody && !b.rawDump && coding != "" {
+        resp.Body = &decodingReader{body: resp.Body, coding: coding}
+        decodedBody(resp)
+    }
+    if b.teeResp != nil && resp.Body != nil {
+        resp.Body = readCloser{io.TeeReader(resp.Body, b.teeResp), resp.Body}
+    }
+}
+
+// send makes the request to rawUrl, following any redirects if asked to.
+func (b *HttpRequestBuilder) send(rawUrl string) (*http.Response, error) {
+    b.history = nil
+    if b.referer != "" {
+        // an earlier attempt may have dropped it on a redirect
+        b.req.Header.Set("Referer", b.referer)
+    }
+    if b.timeout > 0 {
+        b.deadline = time.Now().Add(b.timeout)
+    }
+    // credentials dropped on a redirect to another host are restored for
+    // any retry from the start
+    creds := http.Header{}
+    for _, key := range credentialHeaders {
+        if values, ok := b.req.Header[key]; ok {
+            creds[key] = values
+        }
+    }
+    defer func() {
+        for key, values := range creds {
+            b.req.Header[key] = values
+        }
+    }()
+    for redirects := 0; ; redirects++ {
+        if b.aborted() {
+            return nil, ErrAborted
+        }
+        if b.maxAttempts > 0 && b.attempts >= b.maxAttempts {
+            return nil, fmt.Errorf("httplib: gave up after %d attempts", b.maxAttempts)
+        }
+        b.attempts++
+        if err := b.openBody(); err != nil {
+            return nil, err
+        }
+        conn, resp, err := b.roundTrip(rawUrl)
+        if b.req.Body != nil {
+            // releases a file body even if it was never written
+            b.req.Body.Close()
+        }
+        b.setConn(conn)
+        b.resp = resp
+        if err != nil {
+            if b.aborted() {
+                return nil, ErrAborted
+            }
+            return nil, err
+        }
+        b.history = append(b.history, resp)
+        var location string
+        if isRedirect(resp.StatusCode) {
+            location = resp.Header.Get("Location")
+        } else if b.metaRefresh && b.maxRedirects != 0 {
+            if location, err = b.metaRefreshURL(resp); err != nil {
+                return nil, err
+            }
+        }
+        if b.maxRedirects == 0 || location == "" {
+            return resp, nil
+        }
+        next, err := b.req.URL.Parse(location)
+        resp.Body.Close()
+        b.Close()
+        if err != nil {
+            return nil, err
+        }
+        if redirects >= b.maxRedirects {
+            return nil, fmt.Errorf("httplib: stopped after %d redirects", b.maxRedirects)
+        }
+        if b.noDowngrade && b.req.URL.Scheme == "https" && next.Scheme == "http" {
+            return nil, ErrDowngrade
+        }
+        if next.Host != b.req.URL.Host || (b.req.URL.Scheme == "https" && next.Scheme == "http") {
+            b.req.Header.Del("Referer")
+        }
+        if next.Scheme != b.req.URL.Scheme || next.Host != b.req.URL.Host {
+            for _, key := range credentialHeaders {
+                b.req.Header.Del(key)
+            }
+        }
+        // 307 and 308 must repeat the request as-is, the others become a GET
+        if resp.StatusCode == 307 || resp.StatusCode == 308 {
+            if !b.canResend() {
+                return nil, fmt.Errorf("httplib: can't follow a %d redirect with a non-rewindable body", resp.StatusCode)
+            }
+        } else if b.req.Method != "GET" && b.req.Method != "HEAD" {
+            b.req.Method = "GET"
+            b.req.Body = nil
+            b.req.ContentLength = 0
+            b.req.Header.Del("Content-Type")
+            b.body = nil
+            b.bodyFile = ""
+            b.bodyReader = nil
+            b.files = nil
+        }
+        rawUrl = next.String()
+    }
+}
+
+// roundTrip makes a single request to rawUrl, over a connection from the
+// pool of the Client the builder came from, if any.
+func (b *HttpRequestBuilder) roundTrip(rawUrl string) (*persistConn, *http.Response, error) {
+    if b.pathRewrite != nil {
+        u, err := parseURL(rawUrl)
+        if err != nil {
+            return nil, nil, err
+        }
+        u.Path = b.pathRewrite(u.Path)
+        u.RawPath = ""
+        rawUrl = u.String()
+    }
+    if b.overrideHeader != "" {
+        b.req.Header.Del(b.overrideHeader)
+        if b.req.Method != "GET" && b.req.Method != "POST" {
+            method := b.req.Method
+            b.req.Header.Set(b.overrideHeader, method)
+            b.req.Method = "POST"
+            defer func() { b.req.Method = method }()
+        }
+    }
+    if b.awsSigner != nil {
+        u, err := parseURL(rawUrl)
+        if err != nil {
+            return nil, nil, err
+        }
+        if err := b.signAWS(u); err != nil {
+            return nil, nil, err
+        }
+    }
+    conn, resp, err := b.exchange(rawUrl, b.connOptions())
+    if err != nil {
+        return nil, nil, err
+    }
+    b.sent = sentRequest(b.req)
+    return conn, resp, nil
+}
+
+// sentRequest returns a copy of req as it was sent, without its body, which
+// stays as it is while the builder changes req for redirects and retries.
+func sentRequest(req *http.Request) *http.Request {
+    sent := req.Clone(req.Context())
+    sent.Body = nil
+    sent.GetBody = nil
+    return sent
+}
+
+// exchange sends the request to rawUrl and reads the response, over a
+// connection from the pool of the Client the builder came from, if any.
+func (b *HttpRequestBuilder) exchange(rawUrl string, opts *connOptions) (*persistConn, *http.Response, error) {
+    transport := b.transport
+    if transport == nil && b.client != nil {
+        transport = b.client.Transport
+    }
+    if transport != nil {
+        url, err := parseURL(rawUrl)
+        if err != nil {
+            return nil, nil, err
+        }
+        b.req.URL = url
+        debugRequest(b.req)
+        resp, err := transport.RoundTrip(b.req)
+        if err != nil {
+            return nil, nil, err
+        }
+        if resp.Request == nil {
+            resp.Request = b.req
+        }
+        return nil, resp, nil
+    }
+    if b.client == nil {
+        return getResponse(rawUrl, b.req, opts)
+    }
+    url, err := parseURL(rawUrl)
+    if err != nil {
+        return nil, nil, err
+    }
+    if opts.absoluteURI {
+        absoluteForm(url)
+    }
+    b.req.URL = url
+    debugRequest(b.req)
+
+    key := b.poolKey(url)
+    if b.req.Close {
+        // DisableKeepAlive asks for a connection of its own, never pooled
+        key = ""
+    }
+    if conn := b.client.getIdle(key); conn != nil {
+        conn.setOptions(opts)
+        resp, err := conn.roundTrip(b.req)
+        if err == nil {
+            return conn, resp, nil
+        }
+        // the server may have closed the idle connection, try a new one,
+        // unless the request may have been acted on before it broke
+        b.client.release(conn, false)
+        if !isIdempotent(b.req.Method) || !b.canResend() {
+            return nil, nil, err
+        }
+        if err := b.openBody(); err != nil {
+            return nil, nil, err
+        }
+    }
+    conn, err := b.client.dial(key, url, b.req, opts)
+    if err != nil {
+        return nil, nil, err
+    }
+    resp, err := conn.roundTrip(b.req)
+    if err != nil {
+        b.client.release(conn, false)
+        return nil, nil, err
+    }
+    return conn, resp, nil
+}
+
+// poolKey returns the key of the pooled connections a request to url can
+// use, or "" if it needs a connection of its own.
+func (b *HttpRequestBuilder) poolKey(url *url.URL) string {
+    if b.req.ProtoMajor != 0 {
+        return ""
+    }
+    overrides := make([]string, 0, len(b.resolve))
+    for host, addr := range b.resolve {
+        overrides = append(overrides, host+"="+addr)
+    }
+    sort.Strings(overrides)
+    var socks string
+    if b.socks != nil {
+        socks = b.socks.user + "@" + b.socks.addr
+    }
+    return fmt.Sprintf("%s://%s|%s|%s|%p|%p|%s|%t|%t", url.Scheme, url.Host, b.tlsKey(),
+        strings.Join(overrides, ","), b.dialer, b.dialControl, socks, b.nagle, b.envProxy)
+}
+
+// tlsKey identifies the TLS settings of the builder, for keeping apart the
+// connections and TLS sessions made with different ones.
+func (b *HttpRequestBuilder) tlsKey() string {
+    return fmt.Sprintf("%p|%x|%x|%s|%s", b.tlsConfig, b.minTLS, b.ciphers, b.serverName, strings.Join(b.pins, ","))
+}
+
+// release is done with the connection of the last response. If reusable is
+// set the body was read to the end, so the connection can go back to the
+// Client pool; otherwise it is closed.
+func (b *HttpRequestBuilder) release(reusable bool) {
+    if b.clientConn == nil {
+        return
+    }
+    if b.client != nil {
+        b.client.release(b.clientConn, reusable && !b.aborted())
+    } else {
+        b.clientConn.Close()
+    }
+    b.setConn(nil)
+}
+
+// abortState lets Abort, called from another goroutine, get at the
+// connection of the request in progress, and Pause hold up its reads.
+type abortState struct {
+    mu      sync.Mutex
+    aborted bool
+    resume  chan struct{} // closed by Resume, nil unless paused
+}
+
+// setConn sets the connection of the request in progress, closing it
+// straight away if the request has been aborted.
+func (b *HttpRequestBuilder) setConn(conn *persistConn) {
+    b.abort.mu.Lock()
+    b.clientConn = conn
+    aborted := b.abort.aborted
+    b.abort.mu.Unlock()
+    if aborted && conn != nil {
+        conn.Close()
+    }
+}
+
+func (b *HttpRequestBuilder) aborted() bool {
+    b.abort.mu.Lock()
+    defer b.abort.mu.Unlock()
+    return b.abort.aborted
+}
+
+// Abort stops the request straight away by closing its connection, so the
+// server stops sending, rather than reading the rest of the response as
+// closing it after a partial read may. It is meant to stop a streamed
+// response early, and can be called from any goroutine: the body from
+// AsResponseReader has an Abort method of its own, while StreamLines, which
+// hands out no body, is stopped by calling Abort on b. Reads in progress or
+// to come fail with ErrAborted, as do any retries or further requests with
+// b, and the connection isn't reused.
+func (b *HttpRequestBuilder) Abort() {
+    b.abort.mu.Lock()
+    b.abort.aborted = true
+    conn := b.clientConn
+    if b.abort.resume != nil {
+        close(b.abort.resume)
+        b.abort.resume = nil
+    }
+    b.abort.mu.Unlock()
+    if conn != nil {
+        conn.Close()
+    }
+}
+
+// Pause holds up reading the response body, leaving the connection open, so
+// that the server stalls once the socket buffers fill, until Resume is
+// called. Reads of the body block meanwhile; any bytes already buffered are
+// read once resumed. It is meant for letting the user pause a streamed
+// download, and can be called from any goroutine, as can Resume and Abort,
+// which also ends a pause.
+//
+// Servers and proxies may give up on a connection that stalls for long, so
+// a download paused for more than a minute or so may fail when resumed.
+func (b *HttpRequestBuilder) Pause() {
+    b.abort.mu.Lock()
+    if b.abort.resume == nil && !b.abort.aborted {
+        b.abort.resume = make(chan struct{})
+    }
+    b.abort.mu.Unlock()
+}
+
+// Resume carries on reading a response body held up by Pause.
+func (b *HttpRequestBuilder) Resume() {
+    b.abort.mu.Lock()
+    if b.abort.resume != nil {
+        close(b.abort.resume)
+        b.abort.resume = nil
+    }
+    b.abort.mu.Unlock()
+}
+
+// waitResume blocks while the request is paused.
+func (b *HttpRequestBuilder) waitResume() {
+    b.abort.mu.Lock()
+    resume := b.abort.resume
+    b.abort.mu.Unlock()
+    if resume != nil {
+        <-resume
+    }
+}
+
+// abortableBody reports reads that fail because of Abort as ErrAborted,
+// and holds reads up while paused.
+type abortableBody struct {
+    io.ReadCloser
+    b *HttpRequestBuilder
+}
+
+func (r *abortableBody) Read(p []byte) (int, error) {
+    r.b.waitResume()
+    if r.b.aborted() {
+        return 0, ErrAborted
+    }
+    n, err := r.ReadCloser.Read(p)
+    if err != nil && err != io.EOF && r.b.aborted() {
+        err = ErrAborted
+    }
+    return n, err
+}
+
+// readAll reads the whole response body, then releases its connection.
+func (b *HttpRequestBuilder) readAll(resp *http.Response) ([]byte, error) {
+    if b.maxBodySize <= 0 {
+        data, err := ioutil.ReadAll(resp.Body)
+        b.release(err == nil)
+        return data, err
+    }
+    data, err := ioutil.ReadAll(io.LimitReader(resp.Body, b.maxBodySize+1))
+    if err == nil && int64(len(data)) > b.maxBodySize {
+        b.release(false)
+        return nil, ErrBodyTooLarge
+    }
+    b.release(err == nil)
+    return data, err
+}
+
+// DumpRequest returns the request exactly as it would be written to the
+// wire, without sending it.
+func (b *HttpRequestBuilder) DumpRequest() ([]byte, error) {
+    if b.err != nil {
+        return nil, b.err
+    }
+    url, err := parseURL(b.prepare())
+    if err != nil {
+        return nil, err
+    }
+    b.req.URL = url
+
+    if err := b.resetBody(); err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := b.req.Write(&buf); err != nil {
+        return nil, err
+    }
+    dump := buf.Bytes()
+    if i := bytes.Index(dump, []byte("\r\n\r\n")); i >= 0 {
+        dump = append(dump[0:i+4:i+4], b.dumpBody(b.req.Header, dump[i+4:])...)
+    }
+    return dump, nil
+}
+
+// ToCurl returns a curl command that sends the same request, for reproducing
+// it outside the program, such as in a bug report. The params are folded
+// into the query or body as they are for sending, but nothing is sent. The
+// values of the Authorization and Proxy-Authorization headers are masked,
+// see ToCurlWithAuth. A body from an io.Reader or a file given as bytes
+// can't be rendered and fails it. The command is quoted for a POSIX shell,
+// except that binary data in the body uses the $'...' quoting of bash and
+// zsh.
+func (b *HttpRequestBuilder) ToCurl() (string, error) {
+    return b.toCurl(false)
+}
+
+// ToCurlWithAuth is ToCurl including the values of the Authorization and
+// Proxy-Authorization headers, for when the command is not to be shared.
+func (b *HttpRequestBuilder) ToCurlWithAuth() (string, error) {
+    return b.toCurl(true)
+}
+
+func (b *HttpRequestBuilder) toCurl(withAuth bool) (string, error) {
+    if b.err != nil {
+        return "", b.err
+    }
+    rawUrl := b.prepare()
+    url, err := parseURL(rawUrl)
+    if err != nil {
+        return "", err
+    }
+    if b.pathRewrite != nil {
+        url.Path = b.pathRewrite(url.Path)
+        url.RawPath = ""
+    }
+    method := b.req.Method
+    header := b.req.Header.Clone()
+    if b.overrideHeader != "" && method != "GET" && method != "POST" {
+        header.Set(b.overrideHeader, method)
+        method = "POST"
+    }
+
+    args := []string{"curl"}
+    switch method {
+    case "GET":
+    case "HEAD":
+        args = append(args, "--head")
+    default:
+        args = append(args, "-X", shellQuote(method))
+    }
+    keys := make([]string, 0, len(header))
+    for key := range header {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        for _, value := range header[key] {
+            if !withAuth && (key == "Authorization" || key == "Proxy-Authorization") {
+                value = "REDACTED"
+            }
+            args = append(args, "-H", shellQuote(key+": "+value))
+        }
+    }
+    if !b.noGzip && method != "HEAD" && header.Get("Accept-Encoding") == "" && header.Get("Range") == "" {
+        args = append(args, "--compressed")
+    }
+    if b.useNetrc && header.Get("Authorization") == "" {
+        args = append(args, "--netrc")
+    }
+
+    switch {
+    case len(b.files) > 0:
+        for _, pair := range paramPairs(b.params, b.arrayStyle) {
+            args = append(args, "--form-string", shellQuote(pair[0]+"="+pair[1]))
+        }
+        for _, f := range b.files {
+            if f.path == "" {
+                return "", errors.New("httplib: ToCurl can't render a file given as bytes")
+            }
+            args = append(args, "-F", shellQuote(f.field+"=@"+f.path+";filename="+f.filename))
+        }
+    case b.bodyFile != "":
+        args = append(args, "--data-binary", shellQuote("@"+b.bodyFile))
+    case b.bodyReader != nil:
+        return "", errors.New("httplib: ToCurl can't render a body from an io.Reader")
+    case b.body != nil:
+        args = append(args, "--data-binary", shellQuoteBytes(b.body))
+    }
+    args = append(args, shellQuote(url.String()))
+    return strings.Join(args, " "), nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+    return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteBytes quotes data as a single word, with shellQuote if it is
+// text, or else with the $'...' quoting of bash and zsh, which can escape
+// any byte.
+func shellQuoteBytes(data []byte) string {
+    text := utf8.Valid(data)
+    for _, c := range data {
+        if c < ' ' && c != '\n' && c != '\t' || c == 0x7f {
+            text = false
+        }
+    }
+    if text {
+        return shellQuote(string(data))
+    }
+    var buf strings.Builder
+    buf.WriteString("$'")
+    for _, c := range data {
+        switch {
+        case c == '\\' || c == '\'':
+            buf.WriteByte('\\')
+            buf.WriteByte(c)
+        case c < ' ' || c >= 0x7f:
+            fmt.Fprintf(&buf, "\\x%02x", c)
+        default:
+            buf.WriteByte(c)
+        }
+    }
+    buf.WriteByte('\'')
+    return buf.String()
+}
+
+// DumpResponse returns the response headers and body in their wire format.
+// The body is buffered so that it can still be read from the *http.Response
+// returned by AsResponse. If no request has been made yet, it is made now.
+func (b *HttpRequestBuilder) DumpResponse() ([]byte, error) {
+    resp, err := b.response()
+    if err != nil {
+        return nil, err
+    }
+    var body []byte
+    if resp.Body != nil {
+        var err error
+        body, err = b.readAll(resp)
+        if err != nil {
+            return nil, err
+        }
+        resp.Body = getNopCloser(bytes.NewBuffer(body))
+    }
+    dump, err := httputil.DumpResponse(resp, false)
+    if err != nil {
+        return nil, err
+    }
+    return append(dump, b.dumpBody(resp.Header, body)...), nil
+}
+
+// dumpBody returns a gzip or deflate encoded body decompressed for reading,
+// unless RawDump was set or it fails to decompress.
+func (b *HttpRequestBuilder) dumpBody(header http.Header, body []byte) []byte {
+    coding := headerCoding(header)
+    if b.rawDump || coding == "" {
+        return body
+    }
+    r, err := newDecoder(coding, bytes.NewReader(body))
+    if err != nil {
+        return body
+    }
+    decoded, err := ioutil.ReadAll(r)
+    if err != nil {
+        return body
+    }
+    return decoded
+}
+
+// RawDump makes DumpRequest and DumpResponse keep compressed bodies as
+// the raw compressed bytes instead of decompressing them.
+func (b *HttpRequestBuilder) RawDump() *HttpRequestBuilder {
+    b.rawDump = true
+    return b
+}
+
+// Header sets the header key to value. A key or value containing a CR or LF,
+// which could be used to inject extra headers, fails the request.
+func (b *HttpRequestBuilder) Header(key, value string) *HttpRequestBuilder {
+    if b.checkHeader(key, value) {
+        b.req.Header.Set(key, value)
+    }
+    return b
+}
+
+// AddHeader adds value to the header key, keeping the values it already
+// has, for headers that can be repeated. Each value is sent as a header line
+// of its own.
+func (b *HttpRequestBuilder) AddHeader(key, value string) *HttpRequestBuilder {
+    if b.checkHeader(key, value) {
+        b.req.Header.Add(key, value)
+    }
+    return b
+}
+
+// checkHeader reports whether key and value are free of CR and LF, failing
+// the request if not.
+func (b *HttpRequestBuilder) checkHeader(key, value string) bool {
+    if strings.ContainsAny(key, "\r\n") || strings.ContainsAny(value, "\r\n") {
+        if b.err == nil {
+            b.err = fmt.Errorf("httplib: invalid value for header %q", key)
+        }
+        return false
+    }
+    return true
+}
+
+// Param sets the param key to value, replacing any values it had. Params
+// are held in a map and sent sorted by key, not in the order they were set;
+// use QueryPairs for a query string in a given order.
+func (b *HttpRequestBuilder) Param(key, value string) *HttpRequestBuilder {
+    b.params.Set(key, value)
+    return b
+}
+
+// AddParam adds value to the param key, keeping the values it already has,
+// for params that take a list of values. How a param with several values is
+// sent depends on ArrayFormat.
+func (b *HttpRequestBuilder) AddParam(key, value string) *HttpRequestBuilder {
+    b.params.Add(key, value)
+    return b
+}
+
+// ArrayStyle is how a param with several values is encoded.
+type ArrayStyle int
+
+const (
+    // ArrayRepeat repeats the key, a=1&a=2. This is the default.
+    ArrayRepeat ArrayStyle = iota
+    // ArrayBrackets adds brackets to the key, a[]=1&a[]=2, as Rails and
+    // PHP expect.
+    ArrayBrackets
+    // ArrayIndexed adds the index of each value to the key, a[0]=1&a[1]=2.
+    ArrayIndexed
+)
+
+// ArrayFormat sets how params with several values are encoded, both in
+// the query string and in form bodies. Params with a single value are
+// always sent as key=value.
+func (b *HttpRequestBuilder) ArrayFormat(style ArrayStyle) *HttpRequestBuilder {
+    b.arrayStyle = style
+    return b
+}
+
+// paramPairs returns params as key and value pairs, sorted by key, with the
+// keys of params that have several values written in the given style.
+func paramPairs(params url.Values, style ArrayStyle) [][2]string {
+    keys := make([]string, 0, len(params))
+    for k := range params {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var pairs [][2]string
+    for _, k := range keys {
+        values := params[k]
+        for i, v := range values {
+            key := k
+            if len(values) > 1 {
+                switch style {
+                case ArrayBrackets:
+                    key = k + "[]"
+                case ArrayIndexed:
+                    key = fmt.Sprintf("%s[%d]", k, i)
+                }
+            }
+            pairs = append(pairs, [2]string{key, v})
+        }
+    }
+    return pairs
+}
+
+// MethodOverride sends a request with a method other than GET or POST as a
+// POST, with the real method in the given header, for proxies and servers
+// that only allow GET and POST. header defaults to X-HTTP-Method-Override
+// if empty. The builder keeps the real method, e.g. for redirects.
+func (b *HttpRequestBuilder) MethodOverride(header string) *HttpRequestBuilder {
+    if header == "" {
+        header = "X-HTTP-Method-Override"
+    }
+    b.overrideHeader = header
+    return b
+}
+
+// AbsoluteURI sends the full URL in the request line, as in
+// "GET http://host/path HTTP/1.1", rather than only the path, for talking to
+// a forward proxy directly or to servers that expect it. The Host header is
+// sent as usual.
+func (b *HttpRequestBuilder) AbsoluteURI() *HttpRequestBuilder {
+    b.absoluteURI = true
+    return b
+}
+
+// RawChunks decodes a chunked response body in the library rather than in
+// net/http, keeping the chunk extensions that net/http drops, for protocols
+// that carry data in them. Once the body has been read, Chunks returns the
+// chunks it came in, and the trailer is available as usual, from Trailer or
+// the Trailer of the response. Responses that aren't chunked are read as
+// usual. It has no effect on pipelined requests.
+func (b *HttpRequestBuilder) RawChunks() *HttpRequestBuilder {
+    b.rawChunks = true
+    return b
+}
+
+// Referer sets the Referer header to url, the page the request was made
+// from. It isn't sent on to other hosts, or from https to http, when
+// following redirects.
+func (b *HttpRequestBuilder) Referer(url string) *HttpRequestBuilder {
+    if b.checkHeader("Referer", url) {
+        b.referer = url
+        b.req.Header.Set("Referer", url)
+    }
+    return b
+}
+
+// AcceptLanguage sets the Accept-Language header to langs, in order of
+// preference, such as AcceptLanguage("fr-CH", "fr;q=0.9", "en;q=0.8"). A
+// language may be given a weight with a ";q=" suffix as there.
+func (b *HttpRequestBuilder) AcceptLanguage(langs ...string) *HttpRequestBuilder {
+    return b.Header("Accept-Language", strings.Join(langs, ", "))
+}
+
+// AcceptEncoding sets the Accept-Encoding header to encs, which may be
+// weighted as for AcceptLanguage, such as AcceptEncoding("br", "gzip;q=0.8").
+// It replaces the Accept-Encoding sent by default, and as with one set by
+// Header, the response is then left compressed as sent.
+func (b *HttpRequestBuilder) AcceptEncoding(encs ...string) *HttpRequestBuilder {
+    return b.Header("Accept-Encoding", strings.Join(encs, ", "))
+}
+
+// IfMatch makes the request conditional on the resource still having the
+// given ETag, as returned in the ETag response header of an earlier request,
+// for compare-and-swap updates. If the resource has changed the server
+// responds 412 Precondition Failed, which like any other status is not an
+// error: check it with StatusCode.
+func (b *HttpRequestBuilder) IfMatch(etag string) *HttpRequestBuilder {
+    return b.Header("If-Match", etag)
+}
+
+// RawQuery appends q to the query string verbatim, after any params. The
+// caller is responsible for escaping it.
+func (b *HttpRequestBuilder) RawQuery(q string) *HttpRequestBuilder {
+    if len(b.rawQuery) > 0 {
+        b.rawQuery += "&"
+    }
+    b.rawQuery += q
+    return b
+}
+
+// QueryValues adds every value of v to the query string, keeping repeated
+// keys, whatever the method. Unlike params, the values aren't sent in the
+// body of a POST.
+func (b *HttpRequestBuilder) QueryValues(v url.Values) *HttpRequestBuilder {
+    if len(v) > 0 {
+        b.RawQuery(v.Encode())
+    }
+    return b
+}
+
+// QueryPairs adds the key and value pairs to the query string in the given
+// order, for APIs whose request signatures depend on the order of the
+// params, whatever the method. Keys may repeat. Like RawQuery, the pairs go
+// after any params.
+func (b *HttpRequestBuilder) QueryPairs(pairs [][2]string) *HttpRequestBuilder {
+    if len(pairs) == 0 {
+        return b
+    }
+    encoded := make([]string, len(pairs))
+    for i, pair := range pairs {
+        encoded[i] = url.QueryEscape(pair[0]) + "=" + url.QueryEscape(pair[1])
+    }
+    return b.RawQuery(strings.Join(encoded, "&"))
+}
+
+// QueryStruct adds the fields of the struct v to the query string, named by
+// their `url:"name"` tag or else the field name. Zero values are skipped
+// when the tag has ",omitempty", and fields tagged `url:"-"` are ignored.
+// Fields may be strings, ints, bools, or slices of those, which add a value
+// per element.
+func (b *HttpRequestBuilder) QueryStruct(v interface{}) *HttpRequestBuilder {
+    values, err := structValues(v)
+    if err != nil {
+        if b.err == nil {
+            b.err = err
+        }
+        return b
+    }
+    if len(values) > 0 {
+        b.RawQuery(values.Encode())
+    }
+    return b
+}
+
+func structValues(v interface{}) (url.Values, error) {
+    rv := reflect.ValueOf(v)
+    for rv.Kind() == reflect.Ptr {
+        rv = rv.Elem()
+    }
+    if rv.Kind() != reflect.Struct {
+        return nil, fmt.Errorf("httplib: QueryStruct needs a struct, got %s", rv.Kind())
+    }
+    values := url.Values{}
+    rt := rv.Type()
+    for i := 0; i < rt.NumField(); i++ {
+        field := rt.Field(i)
+        if field.PkgPath != "" {
+            continue // unexported
+        }
+        name, opts := field.Name, ""
+        if tag := field.Tag.Get("url"); tag != "" {
+            name = tag
+            if i := strings.Index(tag, ","); i >= 0 {
+                name, opts = tag[0:i], tag[i:]
+            }
+        }
+        if name == "-" {
+            continue
+        }
+        fv := rv.Field(i)
+        if strings.Contains(opts, ",omitempty") && fv.IsZero() {
+            continue
+        }
+        if fv.Kind() == reflect.Slice {
+            for j := 0; j < fv.Len(); j++ {
+                s, err := queryValue(fv.Index(j))
+                if err != nil {
+                    return nil, fmt.Errorf("httplib: field %s: %s", field.Name, err.Error())
+                }
+                values.Add(name, s)
+            }
+            continue
+        }
+        s, err := queryValue(fv)
+        if err != nil {
+            return nil, fmt.Errorf("httplib: field %s: %s", field.Name, err.Error())
+        }
+        values.Add(name, s)
+    }
+    return values, nil
+}
+
+func queryValue(v reflect.Value) (string, error) {
+    switch v.Kind() {
+    case reflect.String:
+        return v.String(), nil
+    case reflect.Bool:
+        return strconv.FormatBool(v.Bool()), nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return strconv.FormatInt(v.Int(), 10), nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return strconv.FormatUint(v.Uint(), 10), nil
+    }
+    return "", fmt.Errorf("unsupported kind %s", v.Kind())
+}
+
+// Body sets the request body to data, a string, []byte or io.Reader. A
+// reader is streamed chunked as the request is sent, so it can only be sent
+// once; see BufferBody for servers that need a Content-Length, or requests
+// that may be resent by a retry or redirect.
+func (b *HttpRequestBuilder) Body(data interface{}) *HttpRequestBuilder {
+    b.bodyReader = nil
+    switch t := data.(type) {
+    case string:
+        b.body = []byte(t)
+        b.req.ContentLength = int64(len(t))
+    case []byte:
+        b.body = t
+        b.req.ContentLength = int64(len(t))
+    case io.Reader:
+        b.bodyReader = t
+        b.body = nil
+        b.req.ContentLength = 0
+    }
+    b.bodyFile = ""
+    b.files = nil
+    return b
+}
+
+// BodyFile streams the contents of the file at path as the request body.
+// The file is opened when the request is sent, so an error opening it is
+// returned by the As* method, and it is closed once the request completes.
+func (b *HttpRequestBuilder) BodyFile(path string) *HttpRequestBuilder {
+    b.bodyFile = path
+    b.body = nil
+    b.bodyReader = nil
+    b.files = nil
+    return b
+}
+
+// MaxDownloadRate limits reading the response body to bytesPerSec bytes per
+// second. By default reads are unlimited.
+func (b *HttpRequestBuilder) MaxDownloadRate(bytesPerSec int64) *HttpRequestBuilder {
+    b.maxRate = bytesPerSec
+    return b
+}
+
+// CompressRequestAbove gzip compresses request bodies larger than n bytes,
+// sending them with Content-Encoding: gzip, while smaller ones are sent as
+// they are. It applies to bodies in memory, such as from Body or BodyJSON.
+// A body from an io.Reader is read into memory to be measured, as with
+// BufferBody, up to MaxBodySize. BodyFile and File uploads aren't
+// compressed, nor is a body whose Content-Encoding is already set.
+func (b *HttpRequestBuilder) CompressRequestAbove(n int) *HttpRequestBuilder {
+    b.compressAbove = n
+    return b
+}
+
+// BufferBody reads a body set from an io.Reader into memory before sending
+// it, so it goes with a Content-Length rather than chunked, for servers that
+// don't accept chunked requests, and can be resent. A body larger than
+// MaxBodySize fails the request with ErrBodyTooLarge.
+func (b *HttpRequestBuilder) BufferBody() *HttpRequestBuilder {
+    b.bufferBody = true
+    return b
+}
+
+// DisableCompression stops the request asking for a compressed response.
+// By default, unless the request sets its own Accept-Encoding or a Range,
+// or is saved with AsFile, it sends "Accept-Encoding: gzip, deflate" and
+// transparently decompresses a gzip or deflate encoded response, removing
+// its Content-Encoding and Content-Length headers, which no longer describe
+// the body read, and setting the Uncompressed field of the response.
+func (b *HttpRequestBuilder) DisableCompression() *HttpRequestBuilder {
+    b.noGzip = true
+    return b
+}
+
+// RawBody still asks for a compressed response, but leaves it as sent,
+// with its Content-Encoding header, so the As* methods return the
+// compressed bytes, e.g. to relay them elsewhere. Unlike DisableCompression,
+// the server may still compress the response.
+func (b *HttpRequestBuilder) RawBody() *HttpRequestBuilder {
+    b.rawBody = true
+    return b
+}
+
+// DecompressToFile makes AsFile write the decompressed content of a
+// response with Content-Encoding gzip or deflate, removing its
+// Content-Encoding and Content-Length headers. Other responses are written
+// as is, including .gz files served without a Content-Encoding.
+func (b *HttpRequestBuilder) DecompressToFile() *HttpRequestBuilder {
+    b.decompress = true
+    return b
+}
+
+// MaxBodySize limits the bodies read into memory to n bytes, failing with
+// ErrBodyTooLarge beyond it. By default there is no limit.
+func (b *HttpRequestBuilder) MaxBodySize(n int64) *HttpRequestBuilder {
+    b.maxBodySize = n
+    return b
+}
+
+// DisableKeepAlive sends "Connection: close" so the server closes the
+// connection after responding instead of keeping it open for reuse. A
+// request from a Client dials a new connection rather than taking one from
+// the pool, and doesn't return it there.
+func (b *HttpRequestBuilder) DisableKeepAlive() *HttpRequestBuilder {
+    b.req.Close = true
+    return b
+}
+
+// OnUnauthorized sets a callback to fetch a new token when the server
+// responds 401 Unauthorized. The request is then retried once, with the
+// token as a Bearer Authorization header.
+func (b *HttpRequestBuilder) OnUnauthorized(refresh func() (newToken string, err error)) *HttpRequestBuilder {
+    b.refreshToken = refresh
+    return b
+}
+
+// Proto sets the HTTP version the request is sent with, e.g. Proto(1, 0) for
+// HTTP/1.0. The default is HTTP/1.1.
+func (b *HttpRequestBuilder) Proto(major, minor int) *HttpRequestBuilder {
+    b.req.Proto = fmt.Sprintf("HTTP/%d.%d", major, minor)
+    b.req.ProtoMajor = major
+    b.req.ProtoMinor = minor
+    return b
+}
+
+// TransferEncoding sets the transfer encodings of the request body,
+// outermost first. Only "chunked" is supported: []string{"chunked"} sends the
+// body chunked even when its length is known, while nil sends it with a
+// Content-Length.
+func (b *HttpRequestBuilder) TransferEncoding(te []string) *HttpRequestBuilder {
+    b.req.TransferEncoding = te
+    return b
+}
+
+// TLSConfig sets the TLS configuration used for https connections, e.g. to
+// trust additional root CAs or present a client certificate.
+func (b *HttpRequestBuilder) TLSConfig(config *tls.Config) *HttpRequestBuilder {
+    b.tlsConfig = config
+    return b
+}
+
+// MinTLSVersion sets the lowest TLS version https connections may use, such
+// as tls.VersionTLS13, failing the request if the server doesn't support
+// it. It overrides the MinVersion of TLSConfig. The default, unless
+// TLSConfig sets a MinVersion, is TLS 1.2.
+func (b *HttpRequestBuilder) MinTLSVersion(v uint16) *HttpRequestBuilder {
+    b.minTLS = v
+    return b
+}
+
+// ServerName sets the name https connections send as SNI and verify the
+// server certificate against, instead of the host of the URL, for when the
+// address dialed isn't that of the name the certificate is for, such as
+// testing a CDN edge by IP. It overrides the ServerName of TLSConfig. See
+// also ResolveOverride, which keeps the URL and changes the address.
+func (b *HttpRequestBuilder) ServerName(name string) *HttpRequestBuilder {
+    b.serverName = name
+    return b
+}
+
+// CipherSuites limits https connections to the given cipher suites, such as
+// tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, overriding the CipherSuites of
+// TLSConfig. The request fails if a suite isn't one Go implements.
+//
+// The suites only apply to TLS 1.2 and earlier, as TLS 1.3 suites aren't
+// configurable, so a server that supports TLS 1.3 negotiates it regardless.
+// Combined with MinTLSVersion(tls.VersionTLS13) they have no effect.
+func (b *HttpRequestBuilder) CipherSuites(suites []uint16) *HttpRequestBuilder {
+    known := map[uint16]bool{}
+    for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+        known[suite.ID] = true
+    }
+    for _, id := range suites {
+        if !known[id] && b.err == nil {
+            b.err = fmt.Errorf("httplib: unknown cipher suite 0x%04x", id)
+        }
+    }
+    b.ciphers = append([]uint16{}, suites...)
+    return b
+}
+
+// PinCertificate only accepts https connections whose leaf certificate has
+// the given SHA-256 fingerprint, in hex with or without colons, failing the
+// request otherwise. It can be called more than once to accept any of
+// several fingerprints. The normal CA verification still applies.
+func (b *HttpRequestBuilder) PinCertificate(sha256hex string) *HttpRequestBuilder {
+    pin := strings.ToLower(strings.Replace(sha256hex, ":", "", -1))
+    b.pins = append(b.pins, pin)
+    return b
+}
+
+// ResolveOverride connects to addr for requests to host instead of
+// resolving it, like curl --resolve. host is a hostname, or a "host:port" to
+// only override that port; addr is an IP or hostname, with an optional port
+// that defaults to the one of the URL. The Host header, TLS server name and
+// certificate verification still use host. It can be called once per host.
+// Through an http proxy from the environment, an https request asks the
+// proxy to tunnel to addr, while an http request fails, as the proxy would
+// send addr as the Host header.
+func (b *HttpRequestBuilder) ResolveOverride(host, addr string) *HttpRequestBuilder {
+    if b.resolve == nil {
+        b.resolve = map[string]string{}
+    }
+    b.resolve[strings.ToLower(host)] = addr
+    return b
+}
+
+// Timeout limits how long the request may take, from connecting through
+// reading the whole response body. The limit covers any redirects followed
+// together, and starts over when the request is sent again from the start,
+// as by Retry or OnUnauthorized. A request that runs out of time fails
+// with a timeout error from the network connection. By default there is no
+// limit.
+func (b *HttpRequestBuilder) Timeout(d time.Duration) *HttpRequestBuilder {
+    b.timeout = d
+    return b
+}
+
+// FirstByteTimeout limits how long to wait, once the request has been
+// written, for the response to start, failing with ErrFirstByteTimeout
+// when a hung server doesn't answer in time. Unlike Timeout, it puts no
+// limit on how long the rest of the response then takes, so a slow but
+// steady download isn't cut short.
+func (b *HttpRequestBuilder) FirstByteTimeout(d time.Duration) *HttpRequestBuilder {
+    b.firstByte = d
+    return b
+}
+
+// ReadTimeout fails the request if any read from the connection, of the
+// response or its body, makes no progress for d, to detect a stalled
+// transfer without limiting how long a steady one takes, as Timeout does.
+// Like the other timeouts it is backed by a deadline on the socket.
+func (b *HttpRequestBuilder) ReadTimeout(d time.Duration) *HttpRequestBuilder {
+    b.readTimeout = d
+    return b
+}
+
+// WriteTimeout fails the request if any write of the request or its body to
+// the connection makes no progress for d, such as when a server stops
+// reading an upload.
+func (b *HttpRequestBuilder) WriteTimeout(d time.Duration) *HttpRequestBuilder {
+    b.writeTimeout = d
+    return b
+}
+
+// TimeoutSeconds is Timeout in seconds.
+func (b *HttpRequestBuilder) TimeoutSeconds(n int) *HttpRequestBuilder {
+    return b.Timeout(time.Duration(n) * time.Second)
+}
+
+// TimeoutMillis is Timeout in milliseconds.
+func (b *HttpRequestBuilder) TimeoutMillis(n int) *HttpRequestBuilder {
+    return b.Timeout(time.Duration(n) * time.Millisecond)
+}
+
+// HappyEyeballs dials the IPv6 and IPv4 addresses of a host concurrently,
+// after giving the family of its first address a short head start, and uses
+// whichever connects first. This avoids stalling on a dead IPv6 path for
+// hosts with both A and AAAA records.
+func (b *HttpRequestBuilder) HappyEyeballs() *HttpRequestBuilder {
+    b.dualStack = true
+    return b
+}
+
+// Dialer sets the Dialer that connections for the request are made with,
+// instead of the one of the Client it came from or the default. With a
+// proxy, the dialer connects to the proxy.
+func (b *HttpRequestBuilder) Dialer(d Dialer) *HttpRequestBuilder {
+    b.dialer = d
+    return b
+}
+
+// Transport has the request sent by t rather than over a connection of the
+// library, such as to answer it with a MockTransport in tests. Everything
+// else the builder does, such as retries, redirects and decompression,
+// still applies to the responses t returns. The connection settings, such
+// as Dialer or TLSConfig, are then up to t. It isn't used by Client.Pipeline
+// or a KeepAliveSession, which need a connection of their own.
+func (b *HttpRequestBuilder) Transport(t http.RoundTripper) *HttpRequestBuilder {
+    b.transport = t
+    return b
+}
+
+// Socks5Proxy sends the request through the SOCKS5 proxy at addr, as
+// host:port, instead of any proxy set in the environment. user and pass are
+// sent if the proxy asks for them; leave user empty for a proxy without
+// authentication. Host names are resolved by the proxy.
+func (b *HttpRequestBuilder) Socks5Proxy(addr, user, pass string) *HttpRequestBuilder {
+    b.socks = &socks5Dialer{addr: addr, user: user, password: pass}
+    return b
+}
+
+// ProxyFromEnvironment sends the request through the proxy set in the
+// http_proxy or https_proxy environment variables, depending on the scheme
+// of the URL, as command line tools do. Hosts listed in no_proxy, and
+// localhost and loopback addresses, are reached directly. Only http proxies
+// are supported, and a proxy with another scheme fails the request. Under
+// CGI, where a Proxy request header sets it, HTTP_PROXY is ignored.
+func (b *HttpRequestBuilder) ProxyFromEnvironment() *HttpRequestBuilder {
+    b.envProxy = true
+    return b
+}
+
+// connOptions returns the settings for new connections of the builder.
+func (b *HttpRequestBuilder) connOptions() *connOptions {
+    opts := &connOptions{
+        tlsConfig:    b.connTLSConfig(),
+        resolve:      b.resolve,
+        dualStack:    b.dualStack,
+        dialer:       b.dialer,
+        deadline:     b.deadline,
+        firstByte:    b.firstByte,
+        readTimeout:  b.readTimeout,
+        writeTimeout: b.writeTimeout,
+        absoluteURI:  b.absoluteURI,
+        rawChunks:    b.rawChunks,
+        nagle:        b.nagle,
+        envProxy:     b.envProxy,
+    }
+    if b.client != nil {
+        if opts.dialer == nil {
+            opts.dialer = b.client.Dialer
+        }
+        opts.writeBuffer = b.client.WriteBufferSize
+        opts.readBuffer = b.client.ReadBufferSize
+        opts.traffic = &b.client.traffic
+        opts.sessions = b.client.sessionCache(b.tlsKey())
+    }
+    if b.dialControl != nil {
+        switch d := opts.dialer.(type) {
+        case nil:
+            opts.dialer = &net.Dialer{Control: b.dialControl}
+        case *net.Dialer:
+            withControl := *d
+            withControl.Control = chainControl(d.Control, b.dialControl)
+            opts.dialer = &withControl
+        }
+    }
+    if b.socks != nil {
+        socks := *b.socks
+        socks.forward = opts.dialer
+        opts.dialer = &socks
+        opts.envProxy = false
+    }
+    return opts
+}
+
+// chainControl returns a dial control function calling first, if set, and
+// then second.
+func chainControl(first, second func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+    if first == nil {
+        return second
+    }
+    return func(network, address string, c syscall.RawConn) error {
+        if err := first(network, address, c); err != nil {
+            return err
+        }
+        return second(network, address, c)
+    }
+}
+
+// connTLSConfig returns the TLS config for new connections, combining
+// TLSConfig with the other TLS settings of the builder.
+func (b *HttpRequestBuilder) connTLSConfig() *tls.Config {
+    if len(b.pins) == 0 && b.minTLS == 0 && b.ciphers == nil && b.serverName == "" &&
+        b.tlsConfig != nil && b.tlsConfig.MinVersion != 0 {
+        return b.tlsConfig
+    }
+    config := &tls.Config{}
+    if b.tlsConfig != nil {
+        config = b.tlsConfig.Clone()
+    }
+    if b.minTLS != 0 {
+        config.MinVersion = b.minTLS
+    } else if config.MinVersion == 0 {
+        config.MinVersion = tls.VersionTLS12
+    }
+    if b.ciphers != nil {
+        config.CipherSuites = b.ciphers
+    }
+    if b.serverName != "" {
+        config.ServerName = b.serverName
+    }
+    if len(b.pins) == 0 {
+        return config
+    }
+    verify := config.VerifyConnection
+    pins := b.pins
+    config.VerifyConnection = func(state tls.ConnectionState) error {
+        if verify != nil {
+            if err := verify(state); err != nil {
+                return err
+            }
+        }
+        if len(state.PeerCertificates) == 0 {
+            return errors.New("httplib: no certificate to check against pins")
+        }
+        sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+        fingerprint := hex.EncodeToString(sum[:])
+        for _, pin := range pins {
+            if pin == fingerprint {
+                return nil
+            }
+        }
+        return fmt.Errorf("httplib: certificate fingerprint %s matches no pin", fingerprint)
+    }
+    return config
+}
+
+// Tee copies the request body to reqW as it is sent and the response body to
+// respW as it is read, e.g. for audit logging. Either writer may be nil. A
+// request body resent by a redirect or retry is copied again.
+func (b *HttpRequestBuilder) Tee(reqW, respW io.Writer) *HttpRequestBuilder {
+    b.teeReq = reqW
+    b.teeResp = respW
+    return b
+}
+
+// ForceChunked sends the request body with chunked transfer encoding even
+// when its length is known, for servers that behave differently for chunked
+// requests. It is the same as TransferEncoding([]string{"chunked"}).
+func (b *HttpRequestBuilder) ForceChunked() *HttpRequestBuilder {
+    return b.TransferEncoding([]string{"chunked"})
+}
+
+// UseNetrc applies credentials from the .netrc file for the request host as
+// Basic auth, unless an Authorization header is set explicitly. The file is
+// read from the path in the NETRC environment variable, or ~/.netrc.
+func (b *HttpRequestBuilder) UseNetrc() *HttpRequestBuilder {
+    b.useNetrc = true
+    return b
+}
+
+func (b *HttpRequestBuilder) applyNetrc(rawUrl string) error {
+    u, err := parseURL(rawUrl)
+    if err != nil {
+        return err
+    }
+    path := os.Getenv("NETRC")
+    if path == "" {
+        home, err := os.UserHomeDir()
+        if err != nil {
+            return nil
+        }
+        path = home + "/.netrc"
+    }
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    if login, password, ok := netrcCredentials(string(data), u.Hostname()); ok {
+        b.req.SetBasicAuth(login, password)
+    }
+    return nil
+}
+
+// netrcCredentials finds the login and password for host in the contents of
+// a .netrc file, falling back to its default entry.
+func netrcCredentials(netrc, host string) (login, password string, ok bool) {
+    // drop macro definitions, which run from macdef to the next blank line
+    var lines []string
+    inMacro := false
+    for _, line := range strings.Split(netrc, "\n") {
+        if inMacro {
+            inMacro = strings.TrimSpace(line) != ""
+            continue
+        }
+        if f := strings.Fields(line); len(f) > 0 && f[0] == "macdef" {
+            inMacro = true
+            continue
+        }
+        lines = append(lines, line)
+    }
+
+    type entry struct{ login, password string }
+    var current, match, def *entry
+    fields := strings.Fields(strings.Join(lines, "\n"))
+    for i := 0; i < len(fields); i++ {
+        switch fields[i] {
+        case "machine":
+            current = &entry{}
+            if i+1 < len(fields) && fields[i+1] == host && match == nil {
+                match = current
+            }
+            i++
+        case "default":
+            current = &entry{}
+            def = current
+        case "login", "password", "account":
+            if i+1 < len(fields) && current != nil {
+                if fields[i] == "login" {
+                    current.login = fields[i+1]
+                } else if fields[i] == "password" {
+                    current.password = fields[i+1]
+                }
+            }
+            i++
+        }
+    }
+    if match == nil {
+        match = def
+    }
+    if match == nil {
+        return "", "", false
+    }
+    return match.login, match.password, true
+}
+
+// CorrelationID sends a unique ID in the given header, X-Request-ID if
+// header is "", unless the header is already set. IDs come from generate, or
+// are random when it is nil. The same ID is sent on redirects and retries,
+// and can be logged with RequestID.
+func (b *HttpRequestBuilder) CorrelationID(header string, generate func() string) *HttpRequestBuilder {
+    if header == "" {
+        header = "X-Request-ID"
+    }
+    if generate == nil {
+        generate = randomID
+    }
+    b.idHeader = header
+    b.newID = generate
+    return b
+}
+
+// RequestID returns the correlation ID sent with the request, or "" if
+// CorrelationID isn't set or the request hasn't been made.
+func (b *HttpRequestBuilder) RequestID() string {
+    if b.idHeader == "" {
+        return ""
+    }
+    return b.req.Header.Get(b.idHeader)
+}
+
+func randomID() string {
+    id := make([]byte, 16)
+    if _, err := io.ReadFull(rand.Reader, id); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+    return hex.EncodeToString(id)
+}
+
+// FollowRedirects makes the request follow up to max redirects, failing
+// once more are encountered. By default redirect responses are returned to
+// the caller unfollowed. A redirect to another scheme or host drops the
+// Authorization, Proxy-Authorization and Cookie headers of the request. A
+// 307 or 308 redirect, which resends the body, fails for a body streamed from
+// an io.Reader without BufferBody.
+func (b *HttpRequestBuilder) FollowRedirects(max int) *HttpRequestBuilder {
+    b.maxRedirects = max
+    return b
+}
+
+// DialControl has fn called with the socket of each new connection before
+// it connects, to set socket options such as SO_REUSEADDR, bind it to a
+// device or set its TOS bits. An error from fn fails the dial. It applies
+// when connections are dialed by a *net.Dialer, as they are by default, and
+// is ignored with any other Dialer.
+func (b *HttpRequestBuilder) DialControl(fn func(network, address string, c syscall.RawConn) error) *HttpRequestBuilder {
+    b.dialControl = fn
+    return b
+}
+
+// TCPNoDelay sets whether TCP connections are made with the TCP_NODELAY
+// option, which disables Nagle's algorithm so small writes go out at once
+// rather than wait to be coalesced, for lower latency with small requests.
+// It is on by default, as in most HTTP clients; turning it off may save
+// packets when a body is written in many small pieces. It applies to
+// connections dialed as *net.TCPConn, as they are by default, and to https
+// connections, which run over one.
+func (b *HttpRequestBuilder) TCPNoDelay(on bool) *HttpRequestBuilder {
+    b.nagle = !on
+    return b
+}
+
+// PathRewrite has fn rewrite the path of the request, unescaped, just
+// before it is sent, for instance to add or strip a prefix when relaying to
+// a backend with a different base path. The query string, the host dialed
+// and the TLS server name are unaffected. It applies to each redirect too,
+// whose Location is resolved against the rewritten URL.
+func (b *HttpRequestBuilder) PathRewrite(fn func(path string) string) *HttpRequestBuilder {
+    b.pathRewrite = fn
+    return b
+}
+
+// FollowMetaRefresh makes redirects also follow HTML pages that redirect
+// with <meta http-equiv="refresh" content="0; url=...">, fetching the URL
+// straight away whatever the delay. They count towards the limit set with
+// FollowRedirects, without which they aren't followed. The start of HTML
+// responses is read to look for the tag, and put back if there isn't one.
+func (b *HttpRequestBuilder) FollowMetaRefresh() *HttpRequestBuilder {
+    b.metaRefresh = true
+    return b
+}
+
+// metaRefreshLimit is how much of an HTML response is searched for a meta
+// refresh tag, which belongs in the head.
+const metaRefreshLimit = 64 << 10
+
+var (
+    metaTagPattern     = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+    httpEquivPattern   = regexp.MustCompile(`(?i)\shttp-equiv\s*=\s*["']?refresh\b`)
+    metaContentPattern = regexp.MustCompile(`(?is)\scontent\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+    refreshURLPattern  = regexp.MustCompile(`(?is)^\s*[\d.]*\s*[;,]\s*(?:url\s*=\s*)?["']?([^"']*)`)
+)
+
+// metaRefreshURL returns the URL that the HTML response resp redirects to
+// with a meta refresh tag, or "" if it doesn't. The part of the body read to
+// find out is put back.
+func (b *HttpRequestBuilder) metaRefreshURL(resp *http.Response) (string, error) {
+    if resp.Body == nil {
+        return "", nil
+    }
+    mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+        return "", nil
+    }
+    head, err := ioutil.ReadAll(io.LimitReader(resp.Body, metaRefreshLimit))
+    if err != nil {
+        return "", err
+    }
+    resp.Body = readCloser{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+    if coding := contentCoding(resp); b.encodingAdded && !b.rawBody && !b.rawDump && coding != "" {
+        r, err := newDecoder(coding, bytes.NewReader(head))
+        if err != nil {
+            return "", nil
+        }
+        // as much as the truncated stream holds
+        head, _ = ioutil.ReadAll(r)
+    }
+    for _, tag := range metaTagPattern.FindAll(head, -1) {
+        if !httpEquivPattern.Match(tag) {
+            continue
+        }
+        content := metaContentPattern.FindSubmatch(tag)
+        if content == nil {
+            continue
+        }
+        value := string(content[1]) + string(content[2]) + string(content[3])
+        if m := refreshURLPattern.FindStringSubmatch(value); m != nil {
+            return html.UnescapeString(strings.TrimSpace(m[1])), nil
+        }
+    }
+    return "", nil
+}
+
+// Retry retries a failed request up to n times, waiting backoff before the
+// first retry and doubling the wait before each one after. A 429 or 503
+// response with a Retry-After header waits as long as it asks instead,
+// limited by MaxRetryAfter. Which failures are retried is decided by
+// RetryIf.
+//
+// Each retry sends the request from the start on a new connection, as when
+// the connection broke while the body was being written. A body from an
+// io.Reader can't be sent again once read from, so such a request isn't
+// retried after that, unless BufferBody is set.
+func (b *HttpRequestBuilder) Retry(n int, backoff time.Duration) *HttpRequestBuilder {
+    b.retries = n
+    b.retryBackoff = backoff
+    return b
+}
+
+// MaxRetryAfter caps how long a retry waits for a Retry-After header. The
+// default is one minute.
+func (b *HttpRequestBuilder) MaxRetryAfter(max time.Duration) *HttpRequestBuilder {
+    b.maxRetryWait = max
+    return b
+}
+
+// RetryIf sets the predicate consulted after each attempt, with either its
+// response or its error, to decide whether to retry. The default is
+// DefaultRetryIf. Retries are still limited by Retry and MaxAttempts.
+func (b *HttpRequestBuilder) RetryIf(fn func(resp *http.Response, err error) bool) *HttpRequestBuilder {
+    b.retryIf = fn
+    return b
+}
+
+// MaxAttempts limits the total number of requests made, counting every
+// redirect followed and every retry, failing once n have been made. It
+// bounds pathological cases such as a redirect loop where each hop is also
+// retried. Each limit applies on its own, so whichever of FollowRedirects
+// and MaxAttempts is reached first stops the request.
+func (b *HttpRequestBuilder) MaxAttempts(n int) *HttpRequestBuilder {
+    b.maxAttempts = n
+    return b
+}
+
+// NoDowngrade makes a followed redirect from https to plain http fail with
+// ErrDowngrade. Without it such a redirect silently resends the request,
+// including any credentials in its URL or body, unencrypted.
+func (b *HttpRequestBuilder) NoDowngrade() *HttpRequestBuilder {
+    b.noDowngrade = true
+    return b
+}
+
+// AsString returns the response body as a string, which is "" for an empty
+// body and for a response without one alike. Use AsStringOK to tell them
+// apart.
+func (b *HttpRequestBuilder) AsString() (string, error) {
+    resp, err := b.getResponse()
+    if err != nil {
+        return "", err
+    }
+    if resp.Body == nil {
+        return "", nil
+    }
+    data, err := b.readAll(resp)
+    if err != nil {
+        return "", err
+    }
+
+    return string(data), nil
+}
+
+// AsBytes returns the response body. Use AsBytesOK to tell an empty body
+// from a response without one.
+func (b *HttpRequestBuilder) AsBytes() ([]byte, error) {
+    resp, err := b.getResponse()
+    if err != nil {
+        return nil, err
+    }
+    if resp.Body == nil {
+        return nil, nil
+    }
+    data, err := b.readAll(resp)
+    if err != nil {
+        return nil, err
+    }
+
+    return data, nil
+}
+
+// AsBytesInto reads the response body into buf, which can be reused across
+// requests to spare allocating one for each, and returns the number of
+// bytes read. A body larger than buf fills it and fails with
+// ErrBufferTooSmall, leaving the rest unread, and the connection isn't
+// reused.
+func (b *HttpRequestBuilder) AsBytesInto(buf []byte) (int, error) {
+    resp, err := b.getResponse()
+    if err != nil {
+        return 0, err
+    }
+    if resp.Body == nil {
+        return 0, nil
+    }
+    n, err := io.ReadFull(resp.Body, buf)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        b.release(true)
+        return n, nil
+    }
+    if err != nil {
+        b.release(false)
+        return n, err
+    }
+    // buf is full; see whether the body ends there
+    var extra [1]byte
+    m, err := io.ReadFull(resp.Body, extra[:])
+    if m > 0 {
+        b.release(false)
+        return n, ErrBufferTooSmall
+    }
+    if err != io.EOF {
+        b.release(false)
+        return n, err
+    }
+    b.release(true)
+    return n, nil
+}
+
+// AsStringOK is like AsString, but also reports whether the response had a
+// body, to tell a 200 with an empty body, which has one, from a 204 No
+// Content, a 304 Not Modified or the response to a HEAD request, which
+// don't. AsString returns "" for both.
+func (b *HttpRequestBuilder) AsStringOK() (string, bool, error) {
+    data, ok, err := b.AsBytesOK()
+    return string(data), ok, err
+}
+
+// AsBytesOK is like AsBytes, but also reports whether the response had a
+// body, as AsStringOK does. An empty body is returned as an empty, non-nil
+// slice.
+func (b *HttpRequestBuilder) AsBytesOK() ([]byte, bool, error) {
+    resp, err := b.getResponse()
+    if err != nil {
+        return nil, false, err
+    }
+    if !hasBody(resp) {
+        if resp.Body != nil {
+            // lets the connection be reused
+            b.readAll(resp)
+        }
+        return nil, false, nil
+    }
+    data, err := b.readAll(resp)
+    if err != nil {
+        return nil, false, err
+    }
+    if data == nil {
+        data = []byte{}
+    }
+    return data, true, nil
+}
+
+// AsBytesRange returns bytes start through end, inclusive, of the resource.
+// It fails if the server ignores the Range header and doesn't respond 206
+// Partial Content, rather than silently returning the whole resource. Fewer
+// bytes are returned if the resource ends before end.
+func (b *HttpRequestBuilder) AsBytesRange(start, end int64) ([]byte, error) {
+    if start < 0 || start > end {
+        return nil, fmt.Errorf("httplib: invalid byte range %d-%d", start, end)
+    }
+    b.Header("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+    resp, err := b.getResponse()
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != 206 {
+        b.release(false)
+        return nil, fmt.Errorf("httplib: expected 206 Partial Content for a range, got %s", resp.Status)
+    }
+    if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+        b.release(false)
+        return nil, fmt.Errorf("httplib: unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+    }
+    return b.readAll(resp)
+}
+
+// MultiRange requests several byte ranges of the resource at once, each
+// start through end inclusive, to be read with AsRanges.
+func (b *HttpRequestBuilder) MultiRange(ranges [][2]int64) *HttpRequestBuilder {
+    specs := make([]string, len(ranges))
+    for i, r := range ranges {
+        if (r[0] < 0 || r[0] > r[1]) && b.err == nil {
+            b.err = fmt.Errorf("httplib: invalid byte range %d-%d", r[0], r[1])
+        }
+        specs[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+    }
+    if len(ranges) == 0 && b.err == nil {
+        b.err = errors.New("httplib: no byte ranges given")
+    }
+    b.ranges = ranges
+    return b.Header("Range", "bytes="+strings.Join(specs, ","))
 }
 
-func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
-
-func newConn(url *url.URL) (*httputil.ClientConn, error) {
-    addr := url.Host
-    //just set the default scheme to http
-    if url.Scheme == "" {
-        url.Scheme = "http"
+// AsRanges returns the byte ranges set with MultiRange, in the order they
+// were given. A server answers several ranges with a multipart/byteranges
+// body, whose parts are matched to the ranges by their Content-Range. Like
+// AsBytesRange, it fails unless the response is 206 Partial Content, and
+// also if any of the ranges is missing from it.
+func (b *HttpRequestBuilder) AsRanges() ([][]byte, error) {
+    if len(b.ranges) == 0 && b.err == nil {
+        return nil, errors.New("httplib: AsRanges needs the ranges set with MultiRange")
+    }
+    resp, err := b.getResponse()
+    if err != nil {
+        return nil, err
     }
-    if !hasPort(addr) {
-        addr += ":" + url.Scheme
+    if resp.StatusCode != 206 {
+        b.Close()
+        return nil, fmt.Errorf("httplib: expected 206 Partial Content for a range, got %s", resp.Status)
     }
-    var conn net.Conn
-    var err error
-    if url.Scheme == "http" {
-        conn, err = net.Dial("tcp", addr)
+    segments := make([][]byte, len(b.ranges))
+    mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if mediaType != "multipart/byteranges" {
+        // a single range, the server didn't need a multipart body
+        data, err := b.readAll(resp)
         if err != nil {
             return nil, err
         }
-    } else { // https
-        conn, err = tls.Dial("tcp", addr, nil)
-        if err != nil {
+        if err := putRange(b.ranges, segments, resp.Header.Get("Content-Range"), data); err != nil {
             return nil, err
         }
-        h := url.Host
-        if hasPort(h) {
-            h = h[0:strings.LastIndex(h, ":")]
+    } else {
+        mr := multipart.NewReader(resp.Body, params["boundary"])
+        var size int64
+        for {
+            part, err := mr.NextPart()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                b.Close()
+                return nil, err
+            }
+            data, err := ioutil.ReadAll(part)
+            if err != nil {
+                b.Close()
+                return nil, err
+            }
+            size += int64(len(data))
+            if b.maxBodySize > 0 && size > b.maxBodySize {
+                b.Close()
+                return nil, ErrBodyTooLarge
+            }
+            if err := putRange(b.ranges, segments, part.Header.Get("Content-Range"), data); err != nil {
+                b.Close()
+                return nil, err
+            }
         }
-        if err := conn.(*tls.Conn).VerifyHostname(h); err != nil {
-            return nil, err
+        _, err := io.Copy(ioutil.Discard, resp.Body)
+        b.release(err == nil)
+    }
+    for i, segment := range segments {
+        if segment == nil {
+            return nil, fmt.Errorf("httplib: byte range %d-%d missing from the response", b.ranges[i][0], b.ranges[i][1])
         }
     }
+    return segments, nil
+}
 
-    return httputil.NewClientConn(conn, nil), nil
+// putRange stores data, a body with the given Content-Range, as the segment
+// of the requested range that starts at the same offset.
+func putRange(ranges [][2]int64, segments [][]byte, contentRange string, data []byte) error {
+    var start, end int64
+    if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end); err != nil {
+        return fmt.Errorf("httplib: unexpected Content-Range %q", contentRange)
+    }
+    for i, r := range ranges {
+        if r[0] == start && segments[i] == nil {
+            segments[i] = data
+            return nil
+        }
+    }
+    return fmt.Errorf("httplib: unexpected Content-Range %q", contentRange)
 }
 
-func getResponse(rawUrl string, req *http.Request) (*httputil.ClientConn, *http.Response, error) {
-    url, err := url.Parse(rawUrl)
-    if url.Scheme == "" {
-        rawUrl = "http://" + rawUrl
-        url, err = url.Parse(rawUrl)
+// AsJSON decodes the JSON response body into v.
+func (b *HttpRequestBuilder) AsJSON(v interface{}) error {
+    data, err := b.AsBytes()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// AsMap decodes a response body holding a JSON object.
+func (b *HttpRequestBuilder) AsMap() (map[string]interface{}, error) {
+    var v interface{}
+    if err := b.AsJSON(&v); err != nil {
+        return nil, err
+    }
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("httplib: expected a JSON object, got %s", jsonKind(v))
+    }
+    return m, nil
+}
+
+// AsList decodes a response body holding a JSON array.
+func (b *HttpRequestBuilder) AsList() ([]interface{}, error) {
+    var v interface{}
+    if err := b.AsJSON(&v); err != nil {
+        return nil, err
+    }
+    l, ok := v.([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("httplib: expected a JSON array, got %s", jsonKind(v))
+    }
+    return l, nil
+}
+
+func jsonKind(v interface{}) string {
+    switch v.(type) {
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    case string:
+        return "string"
+    case float64:
+        return "number"
+    case bool:
+        return "boolean"
+    }
+    return "null"
+}
+
+// AsFile writes the response body to filename. Unlike the other As*
+// methods, it doesn't ask for a compressed response. The body is written as
+// it was sent, so a compressed response stays compressed on disk unless
+// DecompressToFile is set.
+func (b *HttpRequestBuilder) AsFile(filename string) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
     }
+    defer f.Close()
 
+    b.toFile = true
+    resp, err := b.getResponse()
     if err != nil {
-        return nil, nil, err
+        return err
     }
-    req.URL = url
-    if debugprint {
-        dump, err := httputil.DumpRequest(req, true)
+    if resp.Body == nil {
+        return nil
+    }
+    var body io.Reader = resp.Body
+    if coding := contentCoding(resp); b.decompress && coding != "" {
+        body = &decodingReader{body: resp.Body, coding: coding}
+        decodedBody(resp)
+    }
+    _, err = io.Copy(f, body)
+    b.release(err == nil)
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+// AsLines returns the response body split into lines, without their \n or
+// \r\n line endings. A final line ending doesn't add an empty line, and an
+// empty body gives no lines.
+func (b *HttpRequestBuilder) AsLines() ([]string, error) {
+    s, err := b.AsString()
+    if err != nil {
+        return nil, err
+    }
+    lines := []string{}
+    if s == "" {
+        return lines, nil
+    }
+    for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+        lines = append(lines, strings.TrimSuffix(line, "\r"))
+    }
+    return lines, nil
+}
+
+// StreamLines reads the response body a line at a time as it arrives,
+// calling fn with each line stripped of its line ending, until fn returns
+// false or the body ends. The connection is closed when streaming stops.
+func (b *HttpRequestBuilder) StreamLines(fn func(line string) bool) error {
+    resp, err := b.getResponse()
+    if err != nil {
+        return err
+    }
+    defer b.Close()
+    if resp.Body == nil {
+        return nil
+    }
+    r := bufio.NewReader(resp.Body)
+    for {
+        line, err := r.ReadString('\n')
+        if len(line) > 0 {
+            line = strings.TrimRight(line, "\r\n")
+            if !fn(line) {
+                return nil
+            }
+        }
+        if err == io.EOF {
+            b.release(true)
+            return nil
+        }
         if err != nil {
-            println(err.Error())
+            return err
         }
-        print(string(dump))
     }
+}
 
-    conn, err := newConn(url)
+// StreamJSON reads a stream of newline delimited JSON values from the
+// response body as it arrives, decoding each line into a new value of the
+// type of proto and sending it on out, one line at a time. A pointer proto,
+// such as &Event{}, sends pointers to new values, other protos send values,
+// and a nil proto sends whatever json.Unmarshal makes of the line. Blank
+// lines are skipped. It stops at the end of the body or the first line that
+// fails to decode, and closes out when done.
+func (b *HttpRequestBuilder) StreamJSON(proto interface{}, out chan<- interface{}) error {
+    defer close(out)
+    var decodeErr error
+    err := b.StreamLines(func(line string) bool {
+        if strings.TrimSpace(line) == "" {
+            return true
+        }
+        v, err := decodeLike(proto, []byte(line))
+        if err != nil {
+            decodeErr = err
+            return false
+        }
+        out <- v
+        return true
+    })
     if err != nil {
-        println(err.Error())
-        return nil, nil, err
+        return err
     }
+    return decodeErr
+}
+
+// decodeLike decodes the JSON data into a new value of the type of proto.
+func decodeLike(proto interface{}, data []byte) (interface{}, error) {
+    if proto == nil {
+        var v interface{}
+        err := json.Unmarshal(data, &v)
+        return v, err
+    }
+    t := reflect.TypeOf(proto)
+    if t.Kind() == reflect.Ptr {
+        v := reflect.New(t.Elem())
+        err := json.Unmarshal(data, v.Interface())
+        return v.Interface(), err
+    }
+    v := reflect.New(t)
+    err := json.Unmarshal(data, v.Interface())
+    return v.Elem().Interface(), err
+}
 
-    resp, err := conn.Do(req)
+// AsStatus makes the request and returns just its status code. The body is
+// read and discarded so the connection can be reused, unless it is larger
+// than MaxBodySize, in which case the connection is closed instead.
+func (b *HttpRequestBuilder) AsStatus() (int, error) {
+    resp, err := b.getResponse()
     if err != nil {
-        if err != httputil.ErrPersistEOF {
-            return nil, nil, err
-        }
+        return 0, err
     }
-    return conn, resp, nil
+    if resp.Body == nil {
+        return resp.StatusCode, nil
+    }
+    var body io.Reader = resp.Body
+    if b.maxBodySize > 0 {
+        body = io.LimitReader(body, b.maxBodySize+1)
+    }
+    n, err := io.Copy(ioutil.Discard, body)
+    b.release(err == nil && (b.maxBodySize <= 0 || n <= b.maxBodySize))
+    return resp.StatusCode, err
 }
 
-func Get(url string) *HttpRequestBuilder {
-    var req http.Request
-    req.Method = "GET"
-    req.Header = http.Header{}
-    req.Header.Set("User-Agent", defaultUserAgent)
-    return &HttpRequestBuilder{url, &req, nil, map[string]string{}}
+// AsResponse makes the request and returns the response with its body
+// unread. Closing the body releases the connection as for AsResponseReader.
+func (b *HttpRequestBuilder) AsResponse() (*http.Response, error) {
+    resp, _, err := b.AsResponseReader()
+    return resp, err
 }
 
-func Post(url string) *HttpRequestBuilder {
-    var req http.Request
-    req.Method = "POST"
-    req.Header = http.Header{}
-    req.Header.Set("User-Agent", defaultUserAgent)
-    return &HttpRequestBuilder{url, &req, nil, map[string]string{}}
+// AsResponseReader makes the request and returns the response along with
+// its body, unread, so the headers can be checked before streaming the body.
+// The caller owns the body and must close it, which also resp.Body does, as
+// it is the same reader. Closing it after reading to the end returns the
+// connection to the Client pool for reuse, unless the server asked for it to
+// be closed; closing it earlier, or after a read error, closes the
+// connection. Aborting it stops the response at once, from any goroutine,
+// as for Abort.
+func (b *HttpRequestBuilder) AsResponseReader() (*http.Response, StreamReader, error) {
+    resp, err := b.getResponse()
+    if err != nil {
+        return nil, nil, err
+    }
+    if resp.Body == nil {
+        resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+    }
+    body := &responseBody{ReadCloser: resp.Body, b: b}
+    resp.Body = body
+    return resp, body, nil
 }
 
-func Put(url string) *HttpRequestBuilder {
-    var req http.Request
-    req.Method = "PUT"
-    req.Header = http.Header{}
-    req.Header.Set("User-Agent", defaultUserAgent)
-    return &HttpRequestBuilder{url, &req, nil, map[string]string{}}
+// response returns the response to the last request made, making the
+// request if there wasn't one.
+func (b *HttpRequestBuilder) response() (*http.Response, error) {
+    if b.resp != nil {
+        return b.resp, nil
+    }
+    return b.getResponse()
 }
 
-func Delete(url string) *HttpRequestBuilder {
-    var req http.Request
-    req.Method = "DELETE"
-    req.Header = http.Header{}
-    req.Header.Set("User-Agent", defaultUserAgent)
-    return &HttpRequestBuilder{url, &req, nil, map[string]string{}}
+// NextPage returns a builder for the next page of a paginated collection,
+// the rel="next" link in the Link header of the response, RFC 8288, resolved
+// against the URL of the request. The builder is a GET with the headers,
+// Client and other settings of b, but none of its params or body, nor its
+// Range and conditional If-* headers, which are about the page of b. A next
+// page on another scheme or host gets none of the credentials of b: its
+// Authorization, Proxy-Authorization and Cookie headers and OnUnauthorized
+// callback are dropped. If there is no next page, NextPage returns nil and
+// no error.
+//
+// Call it after reading the page with one of the As* methods. If no request
+// has been made yet, it is made now.
+func (b *HttpRequestBuilder) NextPage() (*HttpRequestBuilder, error) {
+    resp, err := b.response()
+    if err != nil {
+        return nil, err
+    }
+    target := linkTarget(resp.Header["Link"], "next")
+    if target == "" {
+        return nil, nil
+    }
+    next, err := b.req.URL.Parse(target)
+    if err != nil {
+        return nil, err
+    }
+    return b.follow(next), nil
 }
 
-type HttpRequestBuilder struct {
-    url        string
-    req        *http.Request
-    clientConn *httputil.ClientConn
-    params     map[string]string
+// AllPages makes the request and calls fn with the response of each page of
+// a paginated collection in turn, following NextPage, until there are no
+// more pages or fn returns an error, which AllPages returns unless it is
+// ErrStopPages. fn may read the body of the response, which needn't be
+// closed. Every page is requested with the settings of b. AllPages fails
+// rather than fetch more pages than MaxPages.
+func (b *HttpRequestBuilder) AllPages(fn func(resp *http.Response) error) error {
+    max := b.maxPages
+    if max <= 0 {
+        max = defaultMaxPages
+    }
+    page := b
+    for pages := 1; ; pages++ {
+        resp, err := page.getResponse()
+        if err != nil {
+            return err
+        }
+        err = fn(resp)
+        if resp.Body != nil {
+            _, drainErr := io.Copy(ioutil.Discard, resp.Body)
+            page.release(drainErr == nil)
+        }
+        if err == ErrStopPages {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if page, err = page.NextPage(); err != nil || page == nil {
+            return err
+        }
+        if pages == max {
+            return fmt.Errorf("httplib: more than %d pages", max)
+        }
+    }
 }
 
-func (b *HttpRequestBuilder) getResponse() (*http.Response, error) {
-    var paramBody string
-    if b.params != nil && len(b.params) > 0 {
-        var buf bytes.Buffer
-        for k, v := range b.params {
-            buf.WriteString(url.QueryEscape(k))
-            buf.WriteByte('=')
-            buf.WriteString(url.QueryEscape(v))
-            buf.WriteByte('&')
+// MaxPages sets how many pages AllPages fetches at most, 1000 by default.
+func (b *HttpRequestBuilder) MaxPages(n int) *HttpRequestBuilder {
+    b.maxPages = n
+    return b
+}
+
+// linkTarget returns the target URL of the link with relation rel in the
+// Link header values, or "" if there is none. A header value can hold
+// several links, and a link several relations.
+func linkTarget(values []string, rel string) string {
+    for _, v := range values {
+        for {
+            start := strings.Index(v, "<")
+            if start == -1 {
+                break
+            }
+            end := strings.Index(v[start:], ">")
+            if end == -1 {
+                break
+            }
+            target := v[start+1 : start+end]
+            v = v[start+end+1:]
+            params := v
+            if i := strings.Index(v, "<"); i != -1 {
+                params = v[0:i]
+            }
+            for _, param := range strings.Split(params, ";") {
+                param = strings.Trim(strings.TrimSpace(param), ",")
+                i := strings.Index(param, "=")
+                if i == -1 || !strings.EqualFold(strings.TrimSpace(param[0:i]), "rel") {
+                    continue
+                }
+                for _, r := range strings.Fields(strings.Trim(strings.TrimSpace(param[i+1:]), `"`)) {
+                    if strings.EqualFold(r, rel) {
+                        return target
+                    }
+                }
+            }
         }
-        paramBody = buf.String()
-        paramBody = paramBody[0 : len(paramBody)-1]
     }
-    if b.req.Method == "GET" && len(paramBody) > 0 {
-        if strings.Index(b.url, "?") != -1 {
-            b.url += "&" + paramBody
-        } else {
-            b.url = b.url + "?" + paramBody
+    return ""
+}
+
+// pageHeaders are the headers about the resource of a request, not sent on
+// to the next page by NextPage.
+var pageHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// follow returns a builder for a GET of next with the settings of b, such
+// as its headers, Client and TLS options, but none of its params, body,
+// response or range and conditional headers, nor its credentials if next is
+// on another scheme or host.
+func (b *HttpRequestBuilder) follow(next *url.URL) *HttpRequestBuilder {
+    n := *b
+    n.url = next.String()
+    n.req = &http.Request{
+        Method:     "GET",
+        Proto:      b.req.Proto,
+        ProtoMajor: b.req.ProtoMajor,
+        ProtoMinor: b.req.ProtoMinor,
+        Header:     b.req.Header.Clone(),
+        Close:      b.req.Close,
+    }
+    n.req.Header.Del("Content-Type")
+    if next.Scheme != b.req.URL.Scheme || next.Host != b.req.URL.Host {
+        for _, key := range credentialHeaders {
+            n.req.Header.Del(key)
+        }
+        n.refreshToken = nil
+    }
+    if n.idHeader != "" {
+        // each request gets an ID of its own
+        n.req.Header.Del(n.idHeader)
+    }
+    for _, key := range pageHeaders {
+        n.req.Header.Del(key)
+    }
+    n.ranges = nil
+    n.params = url.Values{}
+    n.rawQuery = ""
+    n.body = nil
+    n.bodyFile = ""
+    n.bodyReader = nil
+    n.files = nil
+    n.resp = nil
+    n.history = nil
+    n.clientConn = nil
+    n.abort = &abortState{}
+    n.attempts = 0
+    n.pins = append([]string(nil), b.pins...)
+    n.validators = append([]func(*http.Response) error(nil), b.validators...)
+    n.redact = append([]string(nil), b.redact...)
+    if b.resolve != nil {
+        n.resolve = map[string]string{}
+        for host, addr := range b.resolve {
+            n.resolve[host] = addr
         }
-    } else if b.req.Method == "POST" && b.req.Body == nil && len(paramBody) > 0 {
-        b.Header("Content-Type", "application/x-www-form-urlencoded")
-        b.req.Body = nopCloser{bytes.NewBufferString(paramBody)}
-        b.req.ContentLength = int64(len(paramBody))
     }
+    return &n
+}
 
-    conn, resp, err := getResponse(b.url, b.req)
-    b.clientConn = conn
-    return resp, err
+// ExpectContentType makes the request fail unless the response
+// Content-Type starts with mediaType, ignoring parameters such as charset,
+// to catch an HTML error page served with a 200 status where JSON was
+// expected, say. The error holds the Content-Type received and the start of
+// the body. Responses that can't have a body, such as 204 No Content, aren't
+// checked. StatusCode and ResponseHeader still give the response.
+func (b *HttpRequestBuilder) ExpectContentType(mediaType string) *HttpRequestBuilder {
+    b.expectType = mediaType
+    return b
 }
 
-func (b *HttpRequestBuilder) Header(key, value string) *HttpRequestBuilder {
-    b.req.Header.Set(key, value)
+// AllowTruncatedBody accepts a response body that ends short of its
+// Content-Length as it is, for callers that tolerate short reads. By default
+// reading it fails with a *TruncatedError, so that a download cut off
+// partway isn't mistaken for the whole.
+func (b *HttpRequestBuilder) AllowTruncatedBody() *HttpRequestBuilder {
+    b.allowShort = true
     return b
 }
 
-func (b *HttpRequestBuilder) Param(key, value string) *HttpRequestBuilder {
-    b.params[key] = value
+// CheckStatus makes the request fail with a *StatusError if the response
+// has a 4xx or 5xx status, rather than return the error response as any
+// other. The body is read for the error, and StatusCode and ResponseHeader
+// still give the response.
+func (b *HttpRequestBuilder) CheckStatus() *HttpRequestBuilder {
+    b.checkStatus = true
     return b
 }
 
-func (b *HttpRequestBuilder) Body(data interface{}) *HttpRequestBuilder {
-    switch t := data.(type) {
-    case string:
-        b.req.Body = getNopCloser(bytes.NewBufferString(t))
-        b.req.ContentLength = int64(len(t))
-    case []byte:
-        b.req.Body = getNopCloser(bytes.NewBuffer(t))
-        b.req.ContentLength = int64(len(t))
-    }
+// Validate adds fn to check the response before any As* method returns it,
+// which then fails with the error fn returns, such as to require a header or
+// verify a signature. Validators run in the order they were added, after
+// CheckStatus and ExpectContentType, and the first error stops them. They
+// get the response with its body unread, and should leave it so.
+func (b *HttpRequestBuilder) Validate(fn func(*http.Response) error) *HttpRequestBuilder {
+    b.validators = append(b.validators, fn)
     return b
 }
 
-func (b *HttpRequestBuilder) AsString() (string, error) {
-    resp, err := b.getResponse()
+// OnErrorDecode decodes the JSON body of a 4xx or 5xx response into v, a
+// pointer to the error struct of the API, which the *StatusError then holds
+// as its Detail, for typed error details rather than only the start of the
+// body. If the body isn't valid JSON, Detail is nil and the error has the
+// start of the body, as without OnErrorDecode. It implies CheckStatus.
+func (b *HttpRequestBuilder) OnErrorDecode(v interface{}) *HttpRequestBuilder {
+    b.checkStatus = true
+    b.errorTarget = v
+    return b
+}
+
+// StatusCode returns the status code of the response. If no request has
+// been made yet, it is made now.
+func (b *HttpRequestBuilder) StatusCode() (int, error) {
+    resp, err := b.response()
     if err != nil {
-        return "", err
-    }
-    if resp.Body == nil {
-        return "", nil
+        return 0, err
     }
-    data, err := ioutil.ReadAll(resp.Body)
+    return resp.StatusCode, nil
+}
+
+// ResponseHeader returns the first value of the response header key. If no
+// request has been made yet, it is made now.
+func (b *HttpRequestBuilder) ResponseHeader(key string) (string, error) {
+    resp, err := b.response()
     if err != nil {
         return "", err
     }
-
-    return string(data), nil
+    return resp.Header.Get(key), nil
 }
 
-func (b *HttpRequestBuilder) AsBytes() ([]byte, error) {
-    resp, err := b.getResponse()
+// ResponseHeaderMap returns all of the response headers, including every
+// value of multi-valued headers such as Set-Cookie. If no request has been
+// made yet, it is made now.
+func (b *HttpRequestBuilder) ResponseHeaderMap() (http.Header, error) {
+    resp, err := b.response()
     if err != nil {
         return nil, err
     }
-    if resp.Body == nil {
-        return nil, nil
+    return resp.Header, nil
+}
+
+// ContentTypeParsed returns the media type of the response Content-Type,
+// lower-cased, and its parameters such as charset or boundary. It fails if
+// the header is missing or malformed. If no request has been made yet, it is
+// made now.
+func (b *HttpRequestBuilder) ContentTypeParsed() (mediaType string, params map[string]string, err error) {
+    resp, err := b.response()
+    if err != nil {
+        return "", nil, err
+    }
+    contentType := resp.Header.Get("Content-Type")
+    if contentType == "" {
+        return "", nil, errors.New("httplib: response has no Content-Type")
     }
-    data, err := ioutil.ReadAll(resp.Body)
+    mediaType, params, err = mime.ParseMediaType(contentType)
     if err != nil {
+        return "", nil, fmt.Errorf("httplib: invalid Content-Type %q: %v", contentType, err)
+    }
+    return mediaType, params, nil
+}
+
+// RedirectHistory returns every response received while following
+// redirects, in order, ending with the final response. The bodies of all but
+// the final response are closed. Without redirects it holds just the one
+// response. If no request has been made yet, it is made now.
+func (b *HttpRequestBuilder) RedirectHistory() ([]*http.Response, error) {
+    if _, err := b.response(); err != nil {
         return nil, err
     }
+    return b.history, nil
+}
 
-    return data, nil
+// FinalRequest returns the request that got the final response, after any
+// redirects, as it was sent: its method, URL and headers, including those
+// set just before sending such as by AWSV4Sign, and the method actually sent
+// with MethodOverride, for audit logs. Without redirects it is the request
+// as first sent. The values of headers named with RedactHeaders are
+// replaced by "REDACTED". Its body is nil. If no request has been made yet,
+// it is made now.
+func (b *HttpRequestBuilder) FinalRequest() (*http.Request, error) {
+    if _, err := b.response(); err != nil {
+        return nil, err
+    }
+    req := b.sent.Clone(b.sent.Context())
+    for _, key := range b.redact {
+        if values := req.Header.Values(key); len(values) > 0 {
+            redacted := make([]string, len(values))
+            for i := range redacted {
+                redacted[i] = "REDACTED"
+            }
+            req.Header[textproto.CanonicalMIMEHeaderKey(key)] = redacted
+        }
+    }
+    return req, nil
 }
 
-func (b *HttpRequestBuilder) AsFile(filename string) error {
-    f, err := os.Create(filename)
+// RedactHeaders has FinalRequest hide the values of the given headers, such
+// as Authorization or Cookie, so that the request can be logged.
+func (b *HttpRequestBuilder) RedactHeaders(keys ...string) *HttpRequestBuilder {
+    b.redact = append(b.redact, keys...)
+    return b
+}
+
+// TLSState returns the details of the TLS connection the response was
+// received on, such as the peer certificates, version and cipher suite. It
+// fails for requests made over plain http. If no request has been made yet,
+// it is made now.
+func (b *HttpRequestBuilder) TLSState() (*tls.ConnectionState, error) {
+    resp, err := b.response()
     if err != nil {
-        return err
+        return nil, err
     }
-    defer f.Close()
+    if resp.TLS == nil {
+        return nil, errors.New("httplib: response was not received over TLS")
+    }
+    return resp.TLS, nil
+}
 
-    resp, err := b.getResponse()
-    if err != nil {
-        return err
+// BytesRead returns how many bytes of the response body have been read so
+// far, as they came over the wire: before decompression, and short of the
+// Content-Length if the body was cut off. It fails if no request has been
+// made.
+func (b *HttpRequestBuilder) BytesRead() (int64, error) {
+    if b.resp == nil {
+        return 0, errors.New("httplib: no request has been made")
     }
-    if resp.Body == nil {
-        return nil
+    if b.counter == nil {
+        return 0, nil
     }
-    _, err = io.Copy(f, resp.Body)
+    return b.counter.n, nil
+}
+
+// Trailer returns the value of the trailer header key sent after a chunked
+// response body, or "" if there is no such trailer. Trailers only arrive once
+// the body is fully read, so any unread body is drained first. If no request
+// has been made yet, it is made now.
+func (b *HttpRequestBuilder) Trailer(key string) (string, error) {
+    resp, err := b.response()
     if err != nil {
-        return err
+        return "", err
     }
-    return nil
+    if resp.Body != nil {
+        _, err := io.Copy(ioutil.Discard, resp.Body)
+        b.release(err == nil)
+        if err != nil {
+            return "", err
+        }
+    }
+    return resp.Trailer.Get(key), nil
 }
 
-func (b *HttpRequestBuilder) AsResponse() (*http.Response, error) {
-    return b.getResponse()
+// Chunks returns the chunks a chunked response body came in, with their
+// extensions, including the last, empty chunk. It needs RawChunks, and is
+// nil if the response wasn't chunked. Like Trailer, it drains any unread
+// body first, and makes the request if it hasn't been made yet.
+func (b *HttpRequestBuilder) Chunks() ([]Chunk, error) {
+    if !b.rawChunks {
+        return nil, errors.New("httplib: Chunks needs RawChunks")
+    }
+    resp, err := b.response()
+    if err != nil {
+        return nil, err
+    }
+    if resp.Body != nil {
+        _, err := io.Copy(ioutil.Discard, resp.Body)
+        b.release(err == nil)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if b.chunks == nil {
+        return nil, nil
+    }
+    return b.chunks.chunks, nil
 }
 
 func (b *HttpRequestBuilder) Close() {
-    if b.clientConn != nil {
-        b.clientConn.Close()
-    }
+    b.release(false)
 }
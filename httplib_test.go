@@ -1,7 +1,31 @@
 package httplib
 
 import (
+    "bufio"
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "context"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
     "testing"
+    "time"
 )
 
 func TestFluidGet(t *testing.T) {
@@ -13,6 +37,2437 @@ func TestFluidGet(t *testing.T) {
 
 }
 
+func TestDumpRequest(t *testing.T) {
+    dump, err := Get("example.com/search").Param("q", "go lang").Header("X-Test", "1").DumpRequest()
+    if err != nil {
+        t.Fatalf("DumpRequest failed: %s", err.Error())
+    }
+    s := string(dump)
+    for _, want := range []string{"GET /search?q=go+lang HTTP/1.1\r\n", "Host: example.com\r\n", "X-Test: 1\r\n"} {
+        if !strings.Contains(s, want) {
+            t.Fatalf("expected %q in dump:\n%s", want, s)
+        }
+    }
+
+    dump, err = Get("example.com/list?x=1").Param("q", "a").RawQuery("a[]=1&a[]=2").RawQuery("b=%20").DumpRequest()
+    if err != nil || !strings.HasPrefix(string(dump), "GET /list?x=1&q=a&a[]=1&a[]=2&b=%20 HTTP/1.1") {
+        t.Fatalf("unexpected raw query in dump:\n%s", dump)
+    }
+
+    b := Post("example.com/post").Body("hello")
+    dump, err = b.DumpRequest()
+    if err != nil {
+        t.Fatalf("DumpRequest failed: %s", err.Error())
+    }
+    if !strings.HasSuffix(string(dump), "\r\n\r\nhello") {
+        t.Fatalf("expected body in dump:\n%s", dump)
+    }
+    // dumping must not consume the body
+    dump, _ = b.DumpRequest()
+    if !strings.HasSuffix(string(dump), "hello") {
+        t.Fatalf("body was consumed by DumpRequest:\n%s", dump)
+    }
+}
+
+func TestTrailer(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Trailer", "X-Checksum")
+        w.Write([]byte("hello"))
+        w.Header().Set("X-Checksum", "abc123")
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL)
+    defer b.Close()
+    body, err := b.AsString()
+    if err != nil || body != "hello" {
+        t.Fatalf("unexpected body %q, %v", body, err)
+    }
+    v, err := b.Trailer("X-Checksum")
+    if err != nil || v != "abc123" {
+        t.Fatalf("expected trailer abc123, got %q, %v", v, err)
+    }
+    if v, _ := b.Trailer("X-Missing"); v != "" {
+        t.Fatalf("expected empty trailer, got %q", v)
+    }
+}
+
+func TestFollowRedirects(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/loop":
+            http.Redirect(w, r, "/loop", 302)
+        case "/start":
+            http.Redirect(w, r, "/end", 303)
+        default:
+            w.Write([]byte(r.Method + " " + r.URL.Path))
+        }
+    }))
+    defer ts.Close()
+
+    s, err := Post(ts.URL + "/start").Body("data").FollowRedirects(5).AsString()
+    if err != nil || s != "GET /end" {
+        t.Fatalf("expected redirect to be followed as GET, got %q, %v", s, err)
+    }
+    resp, err := Get(ts.URL + "/start").AsResponse()
+    if err != nil || resp.StatusCode != 303 {
+        t.Fatalf("expected unfollowed redirect, got %v", err)
+    }
+    b := Get(ts.URL + "/start").FollowRedirects(5)
+    history, err := b.RedirectHistory()
+    if err != nil || len(history) != 2 || history[0].StatusCode != 303 || history[1].StatusCode != 200 {
+        t.Fatalf("unexpected redirect history %v, %v", history, err)
+    }
+    history, _ = Get(ts.URL + "/end").FollowRedirects(5).RedirectHistory()
+    if len(history) != 1 {
+        t.Fatalf("expected a single response without redirects, got %d", len(history))
+    }
+    if _, err := Get(ts.URL + "/loop").FollowRedirects(3).AsString(); err == nil {
+        t.Fatalf("expected an error for a redirect loop")
+    }
+    _, err = Get(ts.URL + "/loop").FollowRedirects(10).MaxAttempts(4).AsString()
+    if err == nil || !strings.Contains(err.Error(), "4 attempts") {
+        t.Fatalf("expected MaxAttempts to stop the loop, got %v", err)
+    }
+    s, err = Get(ts.URL + "/start").FollowRedirects(10).MaxAttempts(2).AsString()
+    if err != nil || s != "GET /end" {
+        t.Fatalf("expected 2 attempts to be enough, got %q, %v", s, err)
+    }
+}
+
+func TestNoDowngrade(t *testing.T) {
+    plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("plain"))
+    }))
+    defer plain.Close()
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/downgrade":
+            http.Redirect(w, r, plain.URL, 302)
+        case "/secure":
+            http.Redirect(w, r, "/end", 302)
+        default:
+            w.Write([]byte("secure"))
+        }
+    }))
+    defer ts.Close()
+    config := trustServer(ts)
+
+    if _, err := Get(ts.URL + "/downgrade").TLSConfig(config).FollowRedirects(5).NoDowngrade().AsString(); err != ErrDowngrade {
+        t.Fatalf("expected ErrDowngrade, got %v", err)
+    }
+    s, err := Get(ts.URL + "/secure").TLSConfig(config).FollowRedirects(5).NoDowngrade().AsString()
+    if err != nil || s != "secure" {
+        t.Fatalf("expected an https redirect to be followed, got %q, %v", s, err)
+    }
+    s, err = Get(ts.URL + "/downgrade").TLSConfig(config).FollowRedirects(5).AsString()
+    if err != nil || s != "plain" {
+        t.Fatalf("expected the downgrade to be followed without NoDowngrade, got %q, %v", s, err)
+    }
+}
+
+func TestRedirectCredentials(t *testing.T) {
+    other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "%q %q", r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+    }))
+    defer other.Close()
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/same":
+            http.Redirect(w, r, "/end", 302)
+        case "/other":
+            http.Redirect(w, r, other.URL, 302)
+        default:
+            fmt.Fprintf(w, "%q %q", r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+        }
+    }))
+    defer ts.Close()
+
+    for path, want := range map[string]string{"/same": `"Bearer secret" "session=1"`, "/other": `"" ""`} {
+        b := Get(ts.URL+path).Header("Authorization", "Bearer secret").Header("Cookie", "session=1").FollowRedirects(5)
+        if s, err := b.AsString(); err != nil || s != want {
+            t.Fatalf("%s: expected %s, got %s, %v", path, want, s, err)
+        }
+        if b.req.Header.Get("Authorization") == "" {
+            t.Fatalf("%s: expected the credentials to be kept for sending the request again", path)
+        }
+    }
+}
+
+func TestMaxDownloadRate(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write(make([]byte, 5000))
+    }))
+    defer ts.Close()
+
+    start := time.Now()
+    data, err := Get(ts.URL).MaxDownloadRate(10000).AsBytes()
+    if err != nil || len(data) != 5000 {
+        t.Fatalf("unexpected download of %d bytes, %v", len(data), err)
+    }
+    if elapsed := time.Now().Sub(start); elapsed < 400*time.Millisecond {
+        t.Fatalf("download was not throttled, took %s", elapsed)
+    }
+}
+
+// rawServer serves every connection by reading one request and writing
+// response verbatim.
+func rawServer(t *testing.T, response string) net.Listener {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen: %s", err.Error())
+    }
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            http.ReadRequest(bufio.NewReader(c))
+            c.Write([]byte(response))
+            c.Close()
+        }
+    }()
+    return l
+}
+
+func TestBodyUntilClose(t *testing.T) {
+    for _, response := range []string{
+        "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nhello world",
+        "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world",
+    } {
+        l := rawServer(t, response)
+        s, err := Get(l.Addr().String()).AsString()
+        l.Close()
+        if err != nil || s != "hello world" {
+            t.Fatalf("expected body read until close, got %q, %v", s, err)
+        }
+    }
+}
+
+func TestStreamLines(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for _, line := range []string{"data: one\r\n", "\n", "data: two\n", "data: three"} {
+            w.Write([]byte(line))
+            w.(http.Flusher).Flush()
+        }
+    }))
+    defer ts.Close()
+
+    var lines []string
+    err := Get(ts.URL).StreamLines(func(line string) bool {
+        lines = append(lines, line)
+        return true
+    })
+    if err != nil || strings.Join(lines, "|") != "data: one||data: two|data: three" {
+        t.Fatalf("unexpected lines %q, %v", lines, err)
+    }
+
+    lines = nil
+    Get(ts.URL).StreamLines(func(line string) bool {
+        lines = append(lines, line)
+        return false
+    })
+    if len(lines) != 1 {
+        t.Fatalf("expected streaming to stop after one line, got %q", lines)
+    }
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.Header.Get("Connection") + " " + r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    c := new(Client)
+    defer c.Close()
+    pooled, err := c.Get(ts.URL).AsString()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    first, _ := c.Get(ts.URL).DisableKeepAlive().AsString()
+    if !strings.HasPrefix(first, "close ") {
+        t.Fatalf("expected Connection: close, got %q", first)
+    }
+    second, _ := c.Get(ts.URL).DisableKeepAlive().AsString()
+    if first == second || first == "close"+pooled || second == "close"+pooled {
+        t.Fatalf("expected new connections, got %q and %q after %q", first, second, pooled)
+    }
+    again, _ := c.Get(ts.URL).AsString()
+    if again != pooled {
+        t.Fatalf("expected keep-alive by default, got %q then %q", pooled, again)
+    }
+    c.mu.Lock()
+    open := len(c.conns)
+    c.mu.Unlock()
+    if open != 1 {
+        t.Fatalf("expected only the pooled connection left open, got %d", open)
+    }
+}
+
+func TestDo(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.Method + " " + r.Header.Get("X-Test")))
+    }))
+    defer ts.Close()
+
+    req, _ := http.NewRequest("PATCH", ts.URL+"/x", nil)
+    req.Header.Set("X-Test", "yes")
+    resp, err := Do(req)
+    if err != nil {
+        t.Fatalf("Do failed: %s", err.Error())
+    }
+    defer resp.Body.Close()
+    data, _ := ioutil.ReadAll(resp.Body)
+    if string(data) != "PATCH yes" {
+        t.Fatalf("unexpected response %q", data)
+    }
+}
+
+func TestOnUnauthorized(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer fresh" {
+            w.WriteHeader(401)
+            return
+        }
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write(body)
+    }))
+    defer ts.Close()
+
+    refreshes := 0
+    s, err := Post(ts.URL).Header("Authorization", "Bearer stale").Body("payload").OnUnauthorized(func() (string, error) {
+        refreshes++
+        return "fresh", nil
+    }).AsString()
+    if err != nil || s != "payload" || refreshes != 1 {
+        t.Fatalf("expected one refresh and the body resent, got %q, %d, %v", s, refreshes, err)
+    }
+
+    resp, err := Get(ts.URL).OnUnauthorized(func() (string, error) {
+        refreshes++
+        return "still-stale", nil
+    }).AsResponse()
+    if err != nil || resp.StatusCode != 401 || refreshes != 2 {
+        t.Fatalf("expected a single refresh attempt, got %d refreshes, %v", refreshes, err)
+    }
+}
+
+func TestAsMapAndList(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.URL.Query().Get("body")))
+    }))
+    defer ts.Close()
+
+    m, err := Get(ts.URL).Param("body", `{"name":"go","tags":["a"]}`).AsMap()
+    if err != nil || m["name"] != "go" {
+        t.Fatalf("unexpected map %v, %v", m, err)
+    }
+    l, err := Get(ts.URL).Param("body", `[1,"two"]`).AsList()
+    if err != nil || len(l) != 2 || l[1] != "two" {
+        t.Fatalf("unexpected list %v, %v", l, err)
+    }
+    if _, err := Get(ts.URL).Param("body", `[1]`).AsMap(); err == nil || !strings.Contains(err.Error(), "got array") {
+        t.Fatalf("expected an error for an array, got %v", err)
+    }
+    if _, err := Get(ts.URL).Param("body", `{}`).AsList(); err == nil || !strings.Contains(err.Error(), "got object") {
+        t.Fatalf("expected an error for an object, got %v", err)
+    }
+}
+
+func TestBodyFile(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write([]byte(fmt.Sprintf("%d %s", r.ContentLength, body)))
+    }))
+    defer ts.Close()
+
+    f, err := ioutil.TempFile("", "httplib")
+    if err != nil {
+        t.Fatalf("TempFile: %s", err.Error())
+    }
+    defer os.Remove(f.Name())
+    f.Write([]byte("file contents"))
+    f.Close()
+
+    s, err := Put(ts.URL).BodyFile(f.Name()).AsString()
+    if err != nil || s != "13 file contents" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if _, err := Put(ts.URL).BodyFile(f.Name() + ".missing").AsString(); err == nil {
+        t.Fatalf("expected an error for a missing file")
+    }
+}
+
+func TestAddHeader(t *testing.T) {
+    b := Get("http://example.com/").Header("X-Tag", "a").AddHeader("X-Tag", "b").AddHeader("Accept", "text/html")
+    dump, err := b.DumpRequest()
+    if err != nil {
+        t.Fatalf("DumpRequest failed: %s", err.Error())
+    }
+    for _, line := range []string{"X-Tag: a\r\n", "X-Tag: b\r\n", "Accept: text/html\r\n"} {
+        if !strings.Contains(string(dump), line) {
+            t.Fatalf("expected %q in %q", line, dump)
+        }
+    }
+    b.Header("X-Tag", "c")
+    if dump, _ := b.DumpRequest(); strings.Contains(string(dump), "X-Tag: a") || !strings.Contains(string(dump), "X-Tag: c") {
+        t.Fatalf("expected Header to replace every value, got %q", dump)
+    }
+}
+
+func TestHeaderInjection(t *testing.T) {
+    requests := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+    }))
+    defer ts.Close()
+
+    for _, b := range []*HttpRequestBuilder{
+        Get(ts.URL).Header("X-Test", "x\r\nInjected: 1"),
+        Get(ts.URL).Header("X-Test", "x\nInjected: 1"),
+        Get(ts.URL).Header("X-Test\r\nInjected", "1"),
+        Get(ts.URL).AddHeader("X-Test", "x\r\nInjected: 1"),
+    } {
+        _, err := b.AsString()
+        if err == nil || !strings.Contains(err.Error(), "X-Test") {
+            t.Fatalf("expected an error naming the header, got %v", err)
+        }
+    }
+    if requests != 0 {
+        t.Fatalf("expected no requests to be sent, got %d", requests)
+    }
+}
+
+func gzipped(s string) []byte {
+    var buf bytes.Buffer
+    w := gzip.NewWriter(&buf)
+    w.Write([]byte(s))
+    w.Close()
+    return buf.Bytes()
+}
+
+func TestBufferBody(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        fmt.Fprintf(w, "%d %v %s", r.ContentLength, r.TransferEncoding, body)
+    }))
+    defer ts.Close()
+
+    s, err := Post(ts.URL).Body(strings.NewReader("streamed")).AsString()
+    if err != nil || s != "-1 [chunked] streamed" {
+        t.Fatalf("expected a chunked body, got %q, %v", s, err)
+    }
+    s, err = Post(ts.URL).Body(strings.NewReader("buffered")).BufferBody().AsString()
+    if err != nil || s != "8 [] buffered" {
+        t.Fatalf("expected a Content-Length, got %q, %v", s, err)
+    }
+    _, err = Post(ts.URL).Body(strings.NewReader("too large")).BufferBody().MaxBodySize(4).AsString()
+    if err != ErrBodyTooLarge {
+        t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+    }
+}
+
+func TestRedirectReaderBody(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/start" {
+            http.Redirect(w, r, "/end", 307)
+            return
+        }
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write(body)
+    }))
+    defer ts.Close()
+
+    _, err := Post(ts.URL + "/start").Body(strings.NewReader("payload")).FollowRedirects(3).AsString()
+    if err == nil || !strings.Contains(err.Error(), "non-rewindable") {
+        t.Fatalf("expected an error for a read body to resend, got %v", err)
+    }
+    s, err := Post(ts.URL + "/start").Body(strings.NewReader("payload")).BufferBody().FollowRedirects(3).AsString()
+    if err != nil || s != "payload" {
+        t.Fatalf("expected a buffered body to be resent, got %q, %v", s, err)
+    }
+    s, err = Post(ts.URL + "/start").Body("payload").FollowRedirects(3).AsString()
+    if err != nil || s != "payload" {
+        t.Fatalf("expected the body to be resent, got %q, %v", s, err)
+    }
+}
+
+func TestCompression(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+            w.Write([]byte("plain text"))
+            return
+        }
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Write(gzipped("compressed text"))
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL)
+    s, err := b.AsString()
+    if err != nil || s != "compressed text" {
+        t.Fatalf("expected a transparently decompressed body, got %q, %v", s, err)
+    }
+    if encoding, _ := b.ResponseHeader("Content-Encoding"); encoding != "" {
+        t.Fatalf("expected Content-Encoding to be removed, got %q", encoding)
+    }
+    b = Get(ts.URL).RawBody()
+    data, err := b.AsBytes()
+    if err != nil || !bytes.Equal(data, gzipped("compressed text")) {
+        t.Fatalf("expected the raw compressed body, got %q, %v", data, err)
+    }
+    if encoding, _ := b.ResponseHeader("Content-Encoding"); encoding != "gzip" {
+        t.Fatalf("expected Content-Encoding to be kept, got %q", encoding)
+    }
+    if s, err := Get(ts.URL).DisableCompression().AsString(); err != nil || s != "plain text" {
+        t.Fatalf("expected no Accept-Encoding to be sent, got %q, %v", s, err)
+    }
+    // an Accept-Encoding set by the caller leaves the body to them
+    data, err = Get(ts.URL).Header("Accept-Encoding", "gzip").AsBytes()
+    if err != nil || !bytes.Equal(data, gzipped("compressed text")) {
+        t.Fatalf("expected the compressed body, got %q, %v", data, err)
+    }
+}
+
+func TestEmptyGzip(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // a stray Content-Encoding on responses without a body
+        w.Header().Set("Content-Encoding", "gzip")
+        switch r.URL.Path {
+        case "/204":
+            w.WriteHeader(http.StatusNoContent)
+        case "/304":
+            w.WriteHeader(http.StatusNotModified)
+        case "/chunked":
+            w.(http.Flusher).Flush()
+        default:
+            w.Header().Set("Content-Length", "0")
+        }
+    }))
+    defer ts.Close()
+
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    for _, path := range []string{"/204", "/304", "/chunked", "/empty"} {
+        if s, err := Get(ts.URL + path).AsString(); err != nil || s != "" {
+            t.Fatalf("%s: expected an empty body, got %q, %v", path, s, err)
+        }
+        if err := Get(ts.URL + path).RawBody().DecompressToFile().AsFile(filepath.Join(dir, "out")); err != nil {
+            t.Fatalf("%s: AsFile failed: %s", path, err.Error())
+        }
+    }
+    if s, err := NewRequest("HEAD", ts.URL).AsString(); err != nil || s != "" {
+        t.Fatalf("HEAD: expected an empty body, got %q, %v", s, err)
+    }
+}
+
+func TestDecompressToFile(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/encoded" {
+            w.Header().Set("Content-Encoding", "gzip")
+        }
+        w.Write(gzipped("file content"))
+    }))
+    defer ts.Close()
+
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "out")
+    for _, c := range []struct {
+        url        string
+        decompress bool
+        want       string
+    }{
+        {ts.URL + "/encoded", false, string(gzipped("file content"))},
+        {ts.URL + "/encoded", true, "file content"},
+        {ts.URL + "/archive.gz", true, string(gzipped("file content"))},
+    } {
+        b := Get(c.url)
+        if c.decompress {
+            b.DecompressToFile()
+        }
+        if err := b.AsFile(path); err != nil {
+            t.Fatalf("%s: AsFile failed: %s", c.url, err.Error())
+        }
+        if data, _ := ioutil.ReadFile(path); string(data) != c.want {
+            t.Fatalf("%s (decompress %v): unexpected file content %q", c.url, c.decompress, data)
+        }
+    }
+}
+
+func TestDumpGzip(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Write(gzipped("response text"))
+    }))
+    defer ts.Close()
+
+    b := Post(ts.URL).Header("Content-Encoding", "gzip").Body(gzipped("request text"))
+    dump, err := b.DumpRequest()
+    if err != nil || !bytes.HasSuffix(dump, []byte("\r\n\r\nrequest text")) {
+        t.Fatalf("expected decompressed request body:\n%s", dump)
+    }
+    dump, err = b.DumpResponse()
+    if err != nil || !bytes.HasSuffix(dump, []byte("\r\n\r\nresponse text")) {
+        t.Fatalf("expected decompressed response body:\n%s", dump)
+    }
+
+    dump, _ = Get(ts.URL).RawDump().DumpResponse()
+    if !bytes.HasSuffix(dump, gzipped("response text")) {
+        t.Fatalf("expected raw response body:\n%q", dump)
+    }
+}
+
+func TestWebDAV(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "PROPFIND":
+            body, _ := ioutil.ReadAll(r.Body)
+            if r.Header.Get("Depth") != "1" || !strings.Contains(string(body), "<D:propfind") {
+                w.WriteHeader(400)
+                return
+            }
+            w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+            w.WriteHeader(207)
+            w.Write([]byte(`<?xml version="1.0"?><D:multistatus xmlns:D="DAV:"></D:multistatus>`))
+        case "MKCOL":
+            w.WriteHeader(201)
+        case "COPY", "MOVE":
+            if r.Header.Get("Destination") == "" {
+                w.WriteHeader(400)
+                return
+            }
+            w.WriteHeader(204)
+        default:
+            w.WriteHeader(405)
+        }
+    }))
+    defer ts.Close()
+
+    propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`
+    b := NewRequest("PROPFIND", ts.URL+"/dir/").Header("Depth", "1").Header("Content-Type", "application/xml").Body(propfind)
+    resp, err := b.AsResponse()
+    if err != nil || resp.StatusCode != 207 {
+        t.Fatalf("expected 207 Multi-Status, got %v", err)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    if !strings.Contains(string(body), "multistatus") {
+        t.Fatalf("unexpected multistatus body %q", body)
+    }
+
+    expected := map[string]int{"MKCOL": 201, "COPY": 204, "MOVE": 204}
+    for method, status := range expected {
+        resp, err := NewRequest(method, ts.URL+"/a").Header("Destination", ts.URL+"/b").AsResponse()
+        if err != nil || resp.StatusCode != status {
+            t.Fatalf("%s: expected %d, got %v", method, status, err)
+        }
+    }
+}
+
+func TestSkipInterimResponses(t *testing.T) {
+    l := rawServer(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+        "HTTP/1.1 102 Processing\r\n\r\n"+
+        "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+    defer l.Close()
+
+    b := Post(l.Addr().String()).Body("data")
+    s, err := b.AsString()
+    if err != nil || s != "ok" || b.resp.StatusCode != 200 {
+        t.Fatalf("expected the final response, got %q, %v", s, err)
+    }
+}
+
+func TestResponseHeaderMap(t *testing.T) {
+    requests := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        w.Header().Add("Set-Cookie", "a=1")
+        w.Header().Add("Set-Cookie", "b=2")
+        w.Header().Set("ETag", `"v1"`)
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL)
+    h, err := b.ResponseHeaderMap()
+    if err != nil || len(h["Set-Cookie"]) != 2 {
+        t.Fatalf("expected both cookies, got %v, %v", h, err)
+    }
+    etag, err := b.ResponseHeader("Etag")
+    if err != nil || etag != `"v1"` {
+        t.Fatalf("unexpected ETag %q, %v", etag, err)
+    }
+    if requests != 1 {
+        t.Fatalf("expected the response to be reused, got %d requests", requests)
+    }
+}
+
+func TestContentTypeParsed(t *testing.T) {
+    requests := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        if ct := r.URL.Query().Get("type"); ct != "" {
+            w.Header().Set("Content-Type", ct)
+        } else {
+            w.Header()["Content-Type"] = nil
+        }
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL).Param("type", "Text/HTML; Charset=ISO-8859-1")
+    mediaType, params, err := b.ContentTypeParsed()
+    if err != nil || mediaType != "text/html" || params["charset"] != "ISO-8859-1" {
+        t.Fatalf("unexpected result %q %v, %v", mediaType, params, err)
+    }
+    if _, _, err := b.ContentTypeParsed(); err != nil || requests != 1 {
+        t.Fatalf("expected the response to be reused, got %d requests, %v", requests, err)
+    }
+    if _, _, err := Get(ts.URL).ContentTypeParsed(); err == nil {
+        t.Fatalf("expected an error for a missing Content-Type")
+    }
+    if _, _, err := Get(ts.URL).Param("type", "text/html; charset").ContentTypeParsed(); err == nil {
+        t.Fatalf("expected an error for a malformed Content-Type")
+    }
+}
+
+func TestProtoAndTransferEncoding(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write([]byte(fmt.Sprintf("%s %v %d %s", r.Proto, r.TransferEncoding, r.ContentLength, body)))
+    }))
+    defer ts.Close()
+
+    s, err := Post(ts.URL).Proto(1, 0).Body("abc").AsString()
+    if err != nil || s != "HTTP/1.0 [] 3 abc" {
+        t.Fatalf("expected an HTTP/1.0 request, got %q, %v", s, err)
+    }
+    s, err = Post(ts.URL).TransferEncoding([]string{"chunked"}).Body("abc").AsString()
+    if err != nil || s != "HTTP/1.1 [chunked] -1 abc" {
+        t.Fatalf("expected a chunked request, got %q, %v", s, err)
+    }
+}
+
+// trustServer returns a TLS config trusting the certificate of ts.
+func trustServer(ts *httptest.Server) *tls.Config {
+    pool := x509.NewCertPool()
+    pool.AddCert(ts.Certificate())
+    return &tls.Config{RootCAs: pool}
+}
+
+func TestTLSState(t *testing.T) {
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("secure"))
+    }))
+    defer ts.Close()
+
+    if _, err := Get(ts.URL).AsString(); err == nil {
+        t.Fatalf("expected an untrusted certificate to fail")
+    }
+    b := Get(ts.URL).TLSConfig(trustServer(ts))
+    s, err := b.AsString()
+    if err != nil || s != "secure" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    state, err := b.TLSState()
+    if err != nil || len(state.PeerCertificates) == 0 || state.Version == 0 {
+        t.Fatalf("expected the TLS state, got %v", err)
+    }
+
+    plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer plain.Close()
+    if _, err := Get(plain.URL).TLSState(); err == nil {
+        t.Fatalf("expected an error for plain http")
+    }
+}
+
+func TestPinCertificate(t *testing.T) {
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("pinned"))
+    }))
+    defer ts.Close()
+
+    sum := sha256.Sum256(ts.Certificate().Raw)
+    pin := hex.EncodeToString(sum[:])
+    other := strings.Repeat("ab", 32)
+
+    s, err := Get(ts.URL).TLSConfig(trustServer(ts)).PinCertificate(strings.ToUpper(pin)).AsString()
+    if err != nil || s != "pinned" {
+        t.Fatalf("expected a matching pin to succeed, got %q, %v", s, err)
+    }
+    s, err = Get(ts.URL).TLSConfig(trustServer(ts)).PinCertificate(other).PinCertificate(pin).AsString()
+    if err != nil || s != "pinned" {
+        t.Fatalf("expected one of several pins to match, got %q, %v", s, err)
+    }
+    _, err = Get(ts.URL).TLSConfig(trustServer(ts)).PinCertificate(other).AsString()
+    if err == nil || !strings.Contains(err.Error(), pin) {
+        t.Fatalf("expected a pin mismatch, got %v", err)
+    }
+}
+
+func TestTee(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write(bytes.ToUpper(body))
+    }))
+    defer ts.Close()
+
+    var reqLog, respLog bytes.Buffer
+    s, err := Post(ts.URL).Body("audit me").Tee(&reqLog, &respLog).AsString()
+    if err != nil || s != "AUDIT ME" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if reqLog.String() != "audit me" || respLog.String() != "AUDIT ME" {
+        t.Fatalf("unexpected tee output %q, %q", reqLog.String(), respLog.String())
+    }
+
+    respLog.Reset()
+    s, err = Post(ts.URL).Body("one side").Tee(nil, &respLog).AsString()
+    if err != nil || s != "ONE SIDE" || respLog.String() != "ONE SIDE" {
+        t.Fatalf("unexpected one sided tee %q, %q, %v", s, respLog.String(), err)
+    }
+}
+
+func TestRetry(t *testing.T) {
+    requests := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        switch {
+        case r.URL.Path == "/teapot":
+            w.WriteHeader(418)
+        case requests < 3:
+            w.WriteHeader(503)
+        default:
+            body, _ := ioutil.ReadAll(r.Body)
+            w.Write(body)
+        }
+    }))
+    defer ts.Close()
+
+    s, err := Post(ts.URL).Body("again").Retry(3, time.Millisecond).AsString()
+    if err != nil || s != "again" || requests != 3 {
+        t.Fatalf("expected success on the third attempt, got %q after %d, %v", s, requests, err)
+    }
+
+    requests = 0
+    resp, err := Get(ts.URL+"/teapot").Retry(2, time.Millisecond).AsResponse()
+    if err != nil || resp.StatusCode != 418 || requests != 1 {
+        t.Fatalf("expected no retries by default for 418, got %d requests", requests)
+    }
+    requests = 0
+    Get(ts.URL+"/teapot").Retry(2, time.Millisecond).RetryIf(func(resp *http.Response, err error) bool {
+        return err == nil && resp.StatusCode == 418
+    }).AsResponse()
+    if requests != 3 {
+        t.Fatalf("expected RetryIf to retry twice, got %d requests", requests)
+    }
+    requests = 0
+    Get(ts.URL+"/teapot").Retry(5, time.Millisecond).MaxAttempts(2).RetryIf(func(resp *http.Response, err error) bool {
+        return true
+    }).AsResponse()
+    if requests != 2 {
+        t.Fatalf("expected MaxAttempts to limit retries, got %d requests", requests)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    if d, ok := retryAfter("2"); !ok || d != 2*time.Second {
+        t.Fatalf("unexpected delay for seconds: %s", d)
+    }
+    future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+    if d, ok := retryAfter(future); !ok || d < 59*time.Minute || d > time.Hour {
+        t.Fatalf("unexpected delay for a date: %s", d)
+    }
+    past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+    if d, ok := retryAfter(past); !ok || d != 0 {
+        t.Fatalf("unexpected delay for a past date: %s", d)
+    }
+    for _, bad := range []string{"", "-1", "soon"} {
+        if _, ok := retryAfter(bad); ok {
+            t.Fatalf("expected %q to be rejected", bad)
+        }
+    }
+
+    requests := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        if requests == 1 {
+            w.Header().Set("Retry-After", "3600")
+            w.WriteHeader(429)
+        }
+    }))
+    defer ts.Close()
+
+    start := time.Now()
+    resp, err := Get(ts.URL).Retry(1, time.Millisecond).MaxRetryAfter(50 * time.Millisecond).AsResponse()
+    elapsed := time.Now().Sub(start)
+    if err != nil || resp.StatusCode != 200 || elapsed < 50*time.Millisecond || elapsed > time.Second {
+        t.Fatalf("expected a capped Retry-After wait, got %v after %s", err, elapsed)
+    }
+}
+
+func TestChunked(t *testing.T) {
+    l := rawServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n"+
+        "1\r\na\r\n"+
+        "1a;ext=1\r\nbcdefghijklmnopqrstuvwxyz0\r\n"+
+        "3\r\n123\r\n"+
+        "0\r\nX-Sum: 30\r\n\r\n")
+    defer l.Close()
+
+    b := Get(l.Addr().String())
+    data, err := b.AsBytes()
+    if err != nil || string(data) != "abcdefghijklmnopqrstuvwxyz0123" || len(data) != 30 {
+        t.Fatalf("unexpected de-chunked body %q, %v", data, err)
+    }
+    if sum, _ := b.Trailer("X-Sum"); sum != "30" {
+        t.Fatalf("unexpected trailer %q", sum)
+    }
+
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write([]byte(fmt.Sprintf("%v %s", r.TransferEncoding, body)))
+    }))
+    defer ts.Close()
+    s, err := Put(ts.URL).Body("chunks").ForceChunked().AsString()
+    if err != nil || s != "[chunked] chunks" {
+        t.Fatalf("expected a chunked request body, got %q, %v", s, err)
+    }
+}
+
+func TestDownload(t *testing.T) {
+    content := strings.Repeat("0123456789", 100)
+    var ranges []string
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ranges = append(ranges, r.Header.Get("Range"))
+        http.ServeContent(w, r, "data", time.Time{}, strings.NewReader(content))
+    }))
+    defer ts.Close()
+
+    sum := sha256.Sum256([]byte(content))
+    checksum := hex.EncodeToString(sum[:])
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatalf("TempDir: %s", err.Error())
+    }
+    defer os.RemoveAll(dir)
+    dest := dir + "/data"
+
+    if err := Download(ts.URL, dest, checksum); err != nil {
+        t.Fatalf("Download failed: %s", err.Error())
+    }
+    if data, _ := ioutil.ReadFile(dest); string(data) != content {
+        t.Fatalf("unexpected downloaded content")
+    }
+
+    // resume from a partial file left by an interrupted download
+    os.Remove(dest)
+    ioutil.WriteFile(dest+".part", []byte(content[0:300]), 0644)
+    if err := Download(ts.URL, dest, checksum); err != nil {
+        t.Fatalf("resumed Download failed: %s", err.Error())
+    }
+    if data, _ := ioutil.ReadFile(dest); string(data) != content || ranges[1] != "bytes=300-" {
+        t.Fatalf("unexpected resumed download with range %q", ranges[1])
+    }
+
+    os.Remove(dest)
+    err = Download(ts.URL, dest, strings.Repeat("0", 64))
+    if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+        t.Fatalf("expected a checksum mismatch, got %v", err)
+    }
+    if _, err := os.Stat(dest); err == nil {
+        t.Fatalf("expected no file after a checksum mismatch")
+    }
+    if _, err := os.Stat(dest + ".part"); err == nil {
+        t.Fatalf("expected the partial file to be removed")
+    }
+}
+
+func TestNetrcCredentials(t *testing.T) {
+    netrc := `machine other.com login x password y
+macdef init
+cd /pub
+machine example.com login wrong
+
+machine example.com
+    login alice
+    password s3cret
+default login anon password guest`
+    if login, password, ok := netrcCredentials(netrc, "example.com"); !ok || login != "alice" || password != "s3cret" {
+        t.Fatalf("unexpected credentials %q %q", login, password)
+    }
+    if login, password, ok := netrcCredentials(netrc, "unknown.com"); !ok || login != "anon" || password != "guest" {
+        t.Fatalf("unexpected default credentials %q %q", login, password)
+    }
+    if _, _, ok := netrcCredentials("machine a.com login a password b", "b.com"); ok {
+        t.Fatalf("expected no credentials")
+    }
+}
+
+func TestUseNetrc(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        user, pass, _ := r.BasicAuth()
+        w.Write([]byte(user + ":" + pass))
+    }))
+    defer ts.Close()
+
+    f, err := ioutil.TempFile("", "netrc")
+    if err != nil {
+        t.Fatalf("TempFile: %s", err.Error())
+    }
+    defer os.Remove(f.Name())
+    f.Write([]byte("machine 127.0.0.1 login alice password s3cret\n"))
+    f.Close()
+    defer os.Setenv("NETRC", os.Getenv("NETRC"))
+    os.Setenv("NETRC", f.Name())
+
+    if s, err := Get(ts.URL).UseNetrc().AsString(); err != nil || s != "alice:s3cret" {
+        t.Fatalf("expected netrc credentials, got %q, %v", s, err)
+    }
+    b := Get(ts.URL).UseNetrc()
+    b.req.SetBasicAuth("bob", "pw")
+    if s, _ := b.AsString(); s != "bob:pw" {
+        t.Fatalf("expected explicit credentials to win, got %q", s)
+    }
+    if s, _ := Get(ts.URL).AsString(); s != ":" {
+        t.Fatalf("expected no credentials without UseNetrc, got %q", s)
+    }
+}
+
+func TestQueryStruct(t *testing.T) {
+    type search struct {
+        Query   string   `url:"q"`
+        Page    int      `url:"page,omitempty"`
+        Limit   uint     `url:"limit,omitempty"`
+        Exact   bool     `url:"exact"`
+        Tags    []string `url:"tag"`
+        Skipped string   `url:"-"`
+        Plain   string
+        private string
+    }
+    v := search{Query: "go lang", Limit: 10, Tags: []string{"a", "b"}, Skipped: "x", Plain: "p", private: "y"}
+    dump, err := Get("example.com/search").QueryStruct(&v).DumpRequest()
+    if err != nil || !strings.HasPrefix(string(dump), "GET /search?Plain=p&exact=false&limit=10&q=go+lang&tag=a&tag=b HTTP/1.1") {
+        t.Fatalf("unexpected query:\n%s", dump)
+    }
+
+    type bad struct {
+        Ratio float64 `url:"ratio"`
+    }
+    _, err = Get("example.com").QueryStruct(bad{}).DumpRequest()
+    if err == nil || !strings.Contains(err.Error(), "Ratio") {
+        t.Fatalf("expected an error for an unsupported field, got %v", err)
+    }
+}
+
+func TestQueryValues(t *testing.T) {
+    v := url.Values{"tag": {"a", "b"}, "q": {"go lang"}}
+    dump, err := Post("example.com/search?x=1").Param("name", "go").QueryValues(v).DumpRequest()
+    if err != nil || !strings.HasPrefix(string(dump), "POST /search?x=1&q=go+lang&tag=a&tag=b HTTP/1.1") {
+        t.Fatalf("unexpected query:\n%s", dump)
+    }
+    if !strings.HasSuffix(string(dump), "\r\n\r\nname=go") {
+        t.Fatalf("expected params in the body:\n%s", dump)
+    }
+}
+
+func TestQueryPairs(t *testing.T) {
+    pairs := [][2]string{{"z", "1"}, {"a", "x y"}, {"z", "2"}, {"m&n", "="}}
+    dump, err := Get("example.com/api?v=1").Param("b", "2").QueryPairs(pairs).DumpRequest()
+    if err != nil || !strings.HasPrefix(string(dump), "GET /api?v=1&b=2&z=1&a=x+y&z=2&m%26n=%3D HTTP/1.1") {
+        t.Fatalf("unexpected query:\n%s", dump)
+    }
+}
+
+func TestIfMatch(t *testing.T) {
+    etag := `"v1"`
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "PUT" {
+            if r.Header.Get("If-Match") != etag {
+                w.WriteHeader(412)
+                return
+            }
+            etag = `"v2"`
+        }
+        w.Header().Set("ETag", etag)
+    }))
+    defer ts.Close()
+
+    current, _ := Get(ts.URL).ResponseHeader("ETag")
+    status, err := Put(ts.URL).IfMatch(current).Body("update").StatusCode()
+    if err != nil || status != 200 {
+        t.Fatalf("expected the update to succeed, got %d, %v", status, err)
+    }
+    status, err = Put(ts.URL).IfMatch(current).Body("stale update").StatusCode()
+    if err != nil || status != 412 {
+        t.Fatalf("expected 412 Precondition Failed, got %d, %v", status, err)
+    }
+}
+
+func TestCorrelationID(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.Header.Get("X-Request-ID") + r.Header.Get("X-Trace")))
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL).CorrelationID("", nil)
+    s, err := b.AsString()
+    if err != nil || len(s) != 32 || s != b.RequestID() {
+        t.Fatalf("expected a random ID, got %q, %q, %v", s, b.RequestID(), err)
+    }
+    other, _ := Get(ts.URL).CorrelationID("", nil).AsString()
+    if other == s {
+        t.Fatalf("expected distinct IDs, both were %q", s)
+    }
+    s, _ = Get(ts.URL).Header("X-Request-ID", "mine").CorrelationID("", nil).AsString()
+    if s != "mine" {
+        t.Fatalf("expected an existing ID to be kept, got %q", s)
+    }
+    b = Get(ts.URL).CorrelationID("X-Trace", func() string { return "trace-1" })
+    if s, _ = b.AsString(); s != "trace-1" || b.RequestID() != "trace-1" {
+        t.Fatalf("expected the custom header and generator, got %q", s)
+    }
+}
+
+func TestAsBytesRange(t *testing.T) {
+    content := "0123456789abcdef"
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/norange" {
+            w.Write([]byte(content))
+            return
+        }
+        if r.URL.Path == "/badrange" {
+            w.Header().Set("Content-Range", "bytes 5-8/16")
+            w.WriteHeader(206)
+            w.Write([]byte(content[5:9]))
+            return
+        }
+        http.ServeContent(w, r, "data", time.Time{}, strings.NewReader(content))
+    }))
+    defer ts.Close()
+
+    data, err := Get(ts.URL).AsBytesRange(10, 13)
+    if err != nil || string(data) != "abcd" {
+        t.Fatalf("unexpected range %q, %v", data, err)
+    }
+    data, err = Get(ts.URL).AsBytesRange(14, 100)
+    if err != nil || string(data) != "ef" {
+        t.Fatalf("unexpected range past the end %q, %v", data, err)
+    }
+    if _, err := Get(ts.URL+"/norange").AsBytesRange(0, 3); err == nil {
+        t.Fatalf("expected an error when the server ignores Range")
+    }
+    if _, err := Get(ts.URL).AsBytesRange(5, 4); err == nil {
+        t.Fatalf("expected an error for start > end")
+    }
+
+    c := new(Client)
+    defer c.Close()
+    for _, path := range []string{"/norange", "/badrange"} {
+        if _, err := c.Get(ts.URL+path).AsBytesRange(0, 3); err == nil {
+            t.Fatalf("%s: expected an error", path)
+        }
+    }
+    c.mu.Lock()
+    open := len(c.conns)
+    c.mu.Unlock()
+    if open != 0 {
+        t.Fatalf("expected the connections of failed ranges to be closed, got %d open", open)
+    }
+}
+
+func TestAsRanges(t *testing.T) {
+    content := "0123456789abcdefghijklmnopqrstuvwxyz"
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/norange" {
+            w.Write([]byte(content))
+            return
+        }
+        http.ServeContent(w, r, "data", time.Time{}, strings.NewReader(content))
+    }))
+    defer ts.Close()
+
+    segments, err := Get(ts.URL).MultiRange([][2]int64{{20, 24}, {0, 3}, {34, 99}}).AsRanges()
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    if len(segments) != 3 || string(segments[0]) != "klmno" || string(segments[1]) != "0123" || string(segments[2]) != "yz" {
+        t.Fatalf("unexpected segments %q", segments)
+    }
+    segments, err = Get(ts.URL).MultiRange([][2]int64{{10, 12}}).AsRanges()
+    if err != nil || len(segments) != 1 || string(segments[0]) != "abc" {
+        t.Fatalf("unexpected single range %q, %v", segments, err)
+    }
+    if _, err := Get(ts.URL + "/norange").MultiRange([][2]int64{{0, 1}, {4, 5}}).AsRanges(); err == nil {
+        t.Fatalf("expected an error when the server ignores Range")
+    }
+    if _, err := Get(ts.URL).MultiRange([][2]int64{{0, 1}, {5, 4}}).AsRanges(); err == nil {
+        t.Fatalf("expected an error for start > end")
+    }
+    if _, err := Get(ts.URL).AsRanges(); err == nil {
+        t.Fatalf("expected an error without MultiRange")
+    }
+}
+
+func TestURLEncodingAndFragment(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.RequestURI))
+    }))
+    defer ts.Close()
+
+    for rawUrl, want := range map[string]string{
+        "/a%20b/c%2Fd#frag":       "/a%20b/c%2Fd?x=1",
+        "/a%20b?y=2#frag?z=3":     "/a%20b?y=2&x=1",
+        "/caf%C3%A9/file%231.txt": "/caf%C3%A9/file%231.txt?x=1",
+    } {
+        s, err := Get(ts.URL+rawUrl).Param("x", "1").AsString()
+        if err != nil || s != want {
+            t.Fatalf("%s: expected %q on the wire, got %q, %v", rawUrl, want, s, err)
+        }
+    }
+}
+
+func TestResolveOverride(t *testing.T) {
+    handler := func(name string) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.Write([]byte(name + " " + r.Host))
+        })
+    }
+    api := httptest.NewServer(handler("api"))
+    defer api.Close()
+    web := httptest.NewServer(handler("web"))
+    defer web.Close()
+    _, apiPort, _ := net.SplitHostPort(api.Listener.Addr().String())
+
+    b := Get("http://api.test:"+apiPort+"/").
+        ResolveOverride("api.test", "127.0.0.1").
+        ResolveOverride("web.test:80", web.Listener.Addr().String())
+    if s, err := b.AsString(); err != nil || s != "api api.test:"+apiPort {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    b = Get("http://web.test/").
+        ResolveOverride("api.test", "127.0.0.1").
+        ResolveOverride("web.test:80", web.Listener.Addr().String())
+    if s, err := b.AsString(); err != nil || s != "web web.test" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+
+    // the test certificate is valid for example.com
+    ts := httptest.NewTLSServer(handler("tls"))
+    defer ts.Close()
+    s, err := Get("https://example.com/").ResolveOverride("example.com", ts.Listener.Addr().String()).
+        TLSConfig(trustServer(ts)).AsString()
+    if err != nil || s != "tls example.com" {
+        t.Fatalf("unexpected TLS response %q, %v", s, err)
+    }
+    _, err = Get("https://other.test/").ResolveOverride("other.test", ts.Listener.Addr().String()).
+        TLSConfig(trustServer(ts)).AsString()
+    if err == nil {
+        t.Fatalf("expected the certificate to be checked against the original host")
+    }
+}
+
+func TestHappyEyeballs(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    defer ts.Close()
+    live := ts.Listener.Addr().String()
+    // nothing listens on a closed listener's address
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    dead := l.Addr().String()
+    l.Close()
+
+    // dials to "blackhole" hang, like on a dead IPv6 path, until canceled
+    canceled := make(chan bool, 10)
+    dial := func(ctx context.Context, addr string) (net.Conn, error) {
+        if addr == "blackhole" {
+            <-ctx.Done()
+            canceled <- true
+            return nil, ctx.Err()
+        }
+        var d net.Dialer
+        return d.DialContext(ctx, "tcp", addr)
+    }
+    for _, c := range [][2][]string{
+        {{dead}, {live}},
+        {{"blackhole"}, {live}},
+        {{live}, {"blackhole"}},
+        {{dead, live}, {"blackhole"}},
+    } {
+        start := time.Now()
+        conn, err := dialRace(context.Background(), dial, c[0], c[1], 50*time.Millisecond)
+        if err != nil {
+            t.Fatalf("%v: dial failed: %s", c, err.Error())
+        }
+        if conn.RemoteAddr().String() != live {
+            t.Fatalf("%v: expected a connection to %s, got %s", c, live, conn.RemoteAddr())
+        }
+        conn.Close()
+        if elapsed := time.Since(start); elapsed > time.Second {
+            t.Fatalf("%v: expected the live address to win quickly, took %s", c, elapsed)
+        }
+    }
+    select {
+    case <-canceled:
+    case <-time.After(time.Second):
+        t.Fatalf("expected the hanging dial to be canceled")
+    }
+    if _, err := dialRace(context.Background(), dial, []string{dead}, []string{dead}, 50*time.Millisecond); err == nil {
+        t.Fatalf("expected an error when every address is dead")
+    }
+
+    _, port, _ := net.SplitHostPort(live)
+    if s, err := Get("http://localhost:" + port).HappyEyeballs().AsString(); err != nil || s != "ok" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+}
+
+func TestTimeout(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slowbody" {
+            w.Write([]byte("start"))
+            w.(http.Flusher).Flush()
+        }
+        time.Sleep(300 * time.Millisecond)
+        w.Write([]byte("done"))
+    }))
+    defer ts.Close()
+
+    for _, path := range []string{"/", "/slowbody"} {
+        start := time.Now()
+        _, err := Get(ts.URL + path).TimeoutMillis(50).AsString()
+        if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+            t.Fatalf("%s: expected a timeout error, got %v", path, err)
+        }
+        if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+            t.Fatalf("%s: expected the request to stop at the timeout, took %s", path, elapsed)
+        }
+    }
+    if s, err := Get(ts.URL).TimeoutSeconds(5).AsString(); err != nil || s != "done" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+}
+
+func TestNextPage(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+        if page == 0 {
+            page = 1
+        }
+        w.Header().Add("Link", fmt.Sprintf(`<%s/items?page=1>; rel="first", <%s/items?page=3>; rel=last`, "http://"+r.Host, "http://"+r.Host))
+        if page < 3 {
+            w.Header().Add("Link", fmt.Sprintf(`</items?page=%d&x=a,b>; title="next, please"; rel="next prefetch"`, page+1))
+        }
+        fmt.Fprintf(w, "%d %s", page, r.Header.Get("X-Token"))
+    }))
+    defer ts.Close()
+
+    var pages []string
+    b := Get(ts.URL+"/items").Header("X-Token", "t").Param("page", "1")
+    for b != nil {
+        s, err := b.AsString()
+        if err != nil {
+            t.Fatalf("request failed: %s", err.Error())
+        }
+        pages = append(pages, s)
+        if b, err = b.NextPage(); err != nil {
+            t.Fatalf("NextPage failed: %s", err.Error())
+        }
+    }
+    if strings.Join(pages, "|") != "1 t|2 t|3 t" {
+        t.Fatalf("unexpected pages %q", pages)
+    }
+}
+
+func TestNextPageOtherHost(t *testing.T) {
+    other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "%q %q %q %s", r.Header.Get("Authorization"), r.Header.Get("Cookie"),
+            r.Header.Get("Proxy-Authorization"), r.Header.Get("X-Token"))
+    }))
+    defer other.Close()
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/same" {
+            fmt.Fprintf(w, "%q %q", r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+            return
+        }
+        w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, r.URL.Query().Get("next")))
+    }))
+    defer ts.Close()
+
+    for _, c := range []struct {
+        next, want string
+    }{
+        {ts.URL + "/same", `"Bearer secret" "session=1"`},
+        {other.URL, `"" "" "" t`},
+    } {
+        b := Get(ts.URL).Param("next", c.next).Header("Authorization", "Bearer secret").
+            Header("Cookie", "session=1").Header("Proxy-Authorization", "Basic cHJveHk=").Header("X-Token", "t")
+        if _, err := b.AsString(); err != nil {
+            t.Fatal(err)
+        }
+        next, err := b.NextPage()
+        if err != nil || next == nil {
+            t.Fatalf("expected a next page, got %v", err)
+        }
+        if s, err := next.AsString(); err != nil || s != c.want {
+            t.Fatalf("%s: expected %s, got %s, %v", c.next, c.want, s, err)
+        }
+    }
+}
+
+func TestNextPageSettings(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Link", `</next>; rel="next"`)
+        fmt.Fprintf(w, "%q %q %s", r.Header.Get("Range"), r.Header.Get("If-None-Match"), r.Header.Get("X-Token"))
+    }))
+    defer ts.Close()
+
+    ok := func(*http.Response) error { return nil }
+    b := Get(ts.URL).Header("Range", "bytes=0-9").Header("If-None-Match", `"v1"`).Header("X-Token", "t").
+        Validate(ok).Validate(ok).Validate(ok)
+    if _, err := b.AsString(); err != nil {
+        t.Fatal(err)
+    }
+    next, err := b.NextPage()
+    if err != nil || next == nil {
+        t.Fatalf("expected a next page, got %v", err)
+    }
+    errNext := errors.New("next page")
+    next.Validate(func(*http.Response) error { return errNext })
+    b.Validate(ok)
+    if _, err := next.AsString(); err != errNext {
+        t.Fatalf("expected the validator of the next page, got %v", err)
+    }
+    next, _ = b.NextPage()
+    if s, err := next.AsString(); err != nil || s != `"" "" t` {
+        t.Fatalf("expected the range and conditional headers to be dropped, got %s, %v", s, err)
+    }
+}
+
+func TestAllPages(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+        if page < 5 {
+            w.Header().Set("Link", fmt.Sprintf(`<?page=%d>; rel="next"`, page+1))
+        }
+        fmt.Fprintf(w, "%d%s", page, r.Header.Get("X-Token"))
+    }))
+    defer ts.Close()
+
+    var pages []string
+    collect := func(resp *http.Response) error {
+        data, err := ioutil.ReadAll(resp.Body)
+        pages = append(pages, string(data))
+        return err
+    }
+    c := new(Client)
+    defer c.Close()
+    if err := c.Get(ts.URL).Header("X-Token", "t").AllPages(collect); err != nil {
+        t.Fatalf("AllPages failed: %s", err.Error())
+    }
+    if strings.Join(pages, ",") != "0t,1t,2t,3t,4t,5t" {
+        t.Fatalf("unexpected pages %q", pages)
+    }
+
+    pages = nil
+    err := Get(ts.URL).AllPages(func(resp *http.Response) error {
+        collect(resp)
+        if len(pages) == 2 {
+            return ErrStopPages
+        }
+        return nil
+    })
+    if err != nil || len(pages) != 2 {
+        t.Fatalf("expected to stop after 2 pages, got %q, %v", pages, err)
+    }
+
+    pages = nil
+    if err := Get(ts.URL).MaxPages(3).AllPages(collect); err == nil || len(pages) != 3 {
+        t.Fatalf("expected to fail after 3 pages, got %q, %v", pages, err)
+    }
+    pages = nil
+    if err := Get(ts.URL).MaxPages(6).AllPages(collect); err != nil || len(pages) != 6 {
+        t.Fatalf("expected exactly 6 pages to be within MaxPages(6), got %q, %v", pages, err)
+    }
+    boom := errors.New("boom")
+    if err := Get(ts.URL).AllPages(func(*http.Response) error { return boom }); err != boom {
+        t.Fatalf("expected the callback error, got %v", err)
+    }
+}
+
+func TestArrayFormat(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Write([]byte(r.URL.RawQuery + "|" + string(body)))
+    }))
+    defer ts.Close()
+
+    for style, want := range map[ArrayStyle]string{
+        ArrayRepeat:   "id=1&id=2&q=x",
+        ArrayBrackets: "id%5B%5D=1&id%5B%5D=2&q=x",
+        ArrayIndexed:  "id%5B0%5D=1&id%5B1%5D=2&q=x",
+    } {
+        s, err := Get(ts.URL).AddParam("id", "1").AddParam("id", "2").Param("q", "x").ArrayFormat(style).AsString()
+        if err != nil || s != want+"|" {
+            t.Fatalf("style %d: unexpected query %q, %v", style, s, err)
+        }
+        s, err = Post(ts.URL).AddParam("id", "1").AddParam("id", "2").Param("q", "x").ArrayFormat(style).AsString()
+        if err != nil || s != "|"+want {
+            t.Fatalf("style %d: unexpected form body %q, %v", style, s, err)
+        }
+    }
+    if s, _ := Get(ts.URL).AddParam("id", "1").AddParam("id", "2").Param("id", "3").AsString(); s != "id=3|" {
+        t.Fatalf("expected Param to replace every value, got %q", s)
+    }
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/hung" {
+            time.Sleep(300 * time.Millisecond)
+            return
+        }
+        // a slow but steady body
+        for i := 0; i < 5; i++ {
+            w.Write([]byte("x"))
+            w.(http.Flusher).Flush()
+            time.Sleep(40 * time.Millisecond)
+        }
+    }))
+    defer ts.Close()
+
+    start := time.Now()
+    if _, err := Get(ts.URL + "/hung").FirstByteTimeout(50 * time.Millisecond).AsString(); err != ErrFirstByteTimeout {
+        t.Fatalf("expected ErrFirstByteTimeout, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+        t.Fatalf("expected the request to stop at the first byte timeout, took %s", elapsed)
+    }
+    s, err := Get(ts.URL + "/slow").FirstByteTimeout(100 * time.Millisecond).AsString()
+    if err != nil || s != "xxxxx" {
+        t.Fatalf("expected a slow body to be read in full, got %q, %v", s, err)
+    }
+}
+
+func TestReadWriteTimeout(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        pause := 40 * time.Millisecond
+        if r.URL.Path == "/stall" {
+            pause = 300 * time.Millisecond
+        }
+        for i := 0; i < 5; i++ {
+            w.Write([]byte("x"))
+            w.(http.Flusher).Flush()
+            if i == 2 {
+                time.Sleep(pause)
+            }
+            time.Sleep(40 * time.Millisecond)
+        }
+    }))
+    defer ts.Close()
+
+    start := time.Now()
+    _, err := Get(ts.URL + "/stall").ReadTimeout(100 * time.Millisecond).AsString()
+    if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+        t.Fatalf("expected a timeout for a stalled body, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+        t.Fatalf("expected the request to stop when the body stalled, took %s", elapsed)
+    }
+    // takes longer than the read timeout overall, but never stalls for long
+    s, err := Get(ts.URL + "/steady").ReadTimeout(100 * time.Millisecond).AsString()
+    if err != nil || s != "xxxxx" {
+        t.Fatalf("expected a steady body to be read in full, got %q, %v", s, err)
+    }
+
+    // a server that never reads the request
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    done := make(chan bool)
+    defer close(done)
+    go func() {
+        conn, err := l.Accept()
+        if err == nil {
+            <-done
+            conn.Close()
+        }
+    }()
+    start = time.Now()
+    body := io.LimitReader(zeros{}, 256<<20)
+    _, err = Post("http://" + l.Addr().String()).Body(body).WriteTimeout(100 * time.Millisecond).AsString()
+    // net/http wraps the error in a type of its own
+    if err == nil || !strings.Contains(err.Error(), "i/o timeout") {
+        t.Fatalf("expected a timeout writing to a server that doesn't read, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("expected the upload to stop when it stalled, took %s", elapsed)
+    }
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+    for i := range p {
+        p[i] = 0
+    }
+    return len(p), nil
+}
+
+func TestReferer(t *testing.T) {
+    other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("other " + r.Referer()))
+    }))
+    defer other.Close()
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/same":
+            http.Redirect(w, r, "/final", http.StatusFound)
+        case "/cross":
+            http.Redirect(w, r, other.URL, http.StatusFound)
+        default:
+            w.Write([]byte("same " + r.Referer()))
+        }
+    }))
+    defer ts.Close()
+
+    for path, want := range map[string]string{
+        "/final": "same https://example.com/page",
+        "/same":  "same https://example.com/page",
+        "/cross": "other ",
+    } {
+        s, err := Get(ts.URL + path).Referer("https://example.com/page").FollowRedirects(5).AsString()
+        if err != nil || s != want {
+            t.Fatalf("%s: expected %q, got %q, %v", path, want, s, err)
+        }
+    }
+}
+
+func TestAsLines(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.URL.Query().Get("body")))
+    }))
+    defer ts.Close()
+
+    for body, want := range map[string][]string{
+        "":                    {},
+        "one":                 {"one"},
+        "one\ntwo\n":          {"one", "two"},
+        "one\r\ntwo\r\n":      {"one", "two"},
+        "one\n\nthree":        {"one", "", "three"},
+        "one\r\ntwo\nthree\n": {"one", "two", "three"},
+    } {
+        lines, err := Get(ts.URL).Param("body", body).AsLines()
+        if err != nil || lines == nil || fmt.Sprint(lines) != fmt.Sprint(want) || len(lines) != len(want) {
+            t.Fatalf("%q: expected %q, got %q, %v", body, want, lines, err)
+        }
+    }
+}
+
+func TestMethodOverride(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-HTTP-Method-Override"), r.Header.Get("X-Method"))
+    }))
+    defer ts.Close()
+
+    for _, c := range []struct {
+        b    *HttpRequestBuilder
+        want string
+    }{
+        {Put(ts.URL).MethodOverride(""), "POST PUT "},
+        {NewRequest("PATCH", ts.URL).MethodOverride(""), "POST PATCH "},
+        {Delete(ts.URL).MethodOverride("X-Method"), "POST  DELETE"},
+        {Get(ts.URL).MethodOverride(""), "GET  "},
+        {Post(ts.URL).MethodOverride(""), "POST  "},
+    } {
+        s, err := c.b.AsString()
+        if err != nil || s != c.want {
+            t.Fatalf("expected %q, got %q, %v", c.want, s, err)
+        }
+    }
+    b := Put(ts.URL).MethodOverride("")
+    b.AsString()
+    if resp, _ := b.AsResponse(); resp.Request.Method != "PUT" {
+        t.Fatalf("expected the builder to keep the real method, got %s", resp.Request.Method)
+    }
+}
+
+func TestMinTLSVersion(t *testing.T) {
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    })
+    tls10 := httptest.NewUnstartedServer(handler)
+    tls10.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}
+    tls10.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+    tls10.StartTLS()
+    defer tls10.Close()
+    tls11 := httptest.NewUnstartedServer(handler)
+    tls11.TLS = &tls.Config{MinVersion: tls.VersionTLS11, MaxVersion: tls.VersionTLS11}
+    tls11.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+    tls11.StartTLS()
+    defer tls11.Close()
+    tls12 := httptest.NewUnstartedServer(handler)
+    tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+    tls12.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+    tls12.StartTLS()
+    defer tls12.Close()
+
+    if _, err := Get(tls10.URL).TLSConfig(trustServer(tls10)).AsString(); err == nil {
+        t.Fatalf("expected a TLS 1.0 only server to be rejected by default")
+    }
+    if _, err := Get(tls11.URL).TLSConfig(trustServer(tls11)).AsString(); err == nil {
+        t.Fatalf("expected a TLS 1.1 only server to be rejected by default")
+    }
+    for _, config := range []*tls.Config{nil, trustServer(tls11)} {
+        if v := Get(tls11.URL).TLSConfig(config).connTLSConfig().MinVersion; v != tls.VersionTLS12 {
+            t.Fatalf("expected TLS 1.2 as the minimum by default, got %x", v)
+        }
+    }
+    if _, err := Get(tls11.URL).TLSConfig(trustServer(tls11)).ServerName("example.com").AsString(); err == nil ||
+        !strings.Contains(err.Error(), "version") {
+        t.Fatalf("expected the default to hold with other TLS settings, got %v", err)
+    }
+    b := Get(tls12.URL).TLSConfig(trustServer(tls12))
+    if s, err := b.AsString(); err != nil || s != "ok" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    _, err := Get(tls12.URL).TLSConfig(trustServer(tls12)).MinTLSVersion(tls.VersionTLS13).AsString()
+    if err == nil {
+        t.Fatalf("expected a TLS 1.2 server to be rejected with MinTLSVersion(TLS 1.3)")
+    }
+}
+
+func TestCipherSuites(t *testing.T) {
+    ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(tls.CipherSuiteName(r.TLS.CipherSuite)))
+    }))
+    ts.TLS = &tls.Config{
+        MaxVersion:   tls.VersionTLS12,
+        CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305},
+    }
+    ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+    ts.StartTLS()
+    defer ts.Close()
+
+    s, err := Get(ts.URL).TLSConfig(trustServer(ts)).CipherSuites([]uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}).AsString()
+    if err != nil || s != "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    _, err = Get(ts.URL).TLSConfig(trustServer(ts)).CipherSuites([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}).AsString()
+    if err == nil {
+        t.Fatalf("expected the handshake to fail without a common cipher suite")
+    }
+    _, err = Get(ts.URL).TLSConfig(trustServer(ts)).CipherSuites([]uint16{0xfefe}).AsString()
+    if err == nil || !strings.Contains(err.Error(), "0xfefe") {
+        t.Fatalf("expected an error for an unknown cipher suite, got %v", err)
+    }
+}
+
+func TestFollowMetaRefresh(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        page := `<html><head><meta http-equiv="Refresh" content="0; URL='/next?a=1&amp;b=2'"></head></html>`
+        switch r.URL.Path {
+        case "/":
+            w.Header().Set("Content-Type", "text/html; charset=utf-8")
+            if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+                w.Header().Set("Content-Encoding", "gzip")
+                w.Write(gzipped(page))
+                return
+            }
+            w.Write([]byte(page))
+        case "/next":
+            w.Header().Set("Content-Type", "text/html")
+            w.Write([]byte("<html>done " + r.URL.RawQuery + "</html>"))
+        case "/loop":
+            w.Header().Set("Content-Type", "text/html")
+            w.Write([]byte(`<meta content="1;url=/loop" http-equiv="refresh">`))
+        case "/text":
+            w.Header().Set("Content-Type", "text/plain")
+            w.Write([]byte(page))
+        }
+    }))
+    defer ts.Close()
+
+    for _, raw := range []bool{false, true} {
+        b := Get(ts.URL).FollowRedirects(5).FollowMetaRefresh()
+        if raw {
+            b.DisableCompression()
+        }
+        s, err := b.AsString()
+        if err != nil || s != "<html>done a=1&b=2</html>" {
+            t.Fatalf("unexpected response %q, %v", s, err)
+        }
+    }
+    s, err := Get(ts.URL + "/next").FollowRedirects(5).FollowMetaRefresh().AsString()
+    if err != nil || s != "<html>done </html>" {
+        t.Fatalf("expected a page without a meta refresh to be returned whole, got %q, %v", s, err)
+    }
+    if s, _ := Get(ts.URL).FollowMetaRefresh().DisableCompression().AsString(); !strings.Contains(s, "Refresh") {
+        t.Fatalf("expected meta refresh not to be followed without FollowRedirects, got %q", s)
+    }
+    if s, _ := Get(ts.URL+"/text").Header("Content-Type", "").FollowRedirects(5).FollowMetaRefresh().AsString(); !strings.Contains(s, "Refresh") {
+        t.Fatalf("expected meta refresh to be ignored outside HTML, got %q", s)
+    }
+    _, err = Get(ts.URL + "/loop").FollowRedirects(3).FollowMetaRefresh().AsString()
+    if err == nil || !strings.Contains(err.Error(), "3 redirects") {
+        t.Fatalf("expected the redirect limit to apply, got %v", err)
+    }
+}
+
+func TestAsStringOK(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/none":
+            w.WriteHeader(204)
+        case "/body":
+            w.Write([]byte("hello"))
+        }
+    }))
+    defer ts.Close()
+
+    for _, c := range []struct {
+        b    *HttpRequestBuilder
+        want string
+        ok   bool
+    }{
+        {Get(ts.URL + "/none"), "", false},
+        {Get(ts.URL + "/empty"), "", true},
+        {Get(ts.URL + "/body"), "hello", true},
+        {NewRequest("HEAD", ts.URL+"/body"), "", false},
+    } {
+        s, ok, err := c.b.AsStringOK()
+        if err != nil || s != c.want || ok != c.ok {
+            t.Errorf("%s %s: expected %q, %v, got %q, %v, %v", c.b.req.Method, c.b.url, c.want, c.ok, s, ok, err)
+        }
+    }
+    if data, ok, err := Get(ts.URL + "/empty").AsBytesOK(); err != nil || !ok || data == nil || len(data) != 0 {
+        t.Fatalf("expected an empty, non-nil body, got %v, %v, %v", data, ok, err)
+    }
+    if data, ok, err := Get(ts.URL + "/none").AsBytesOK(); err != nil || ok || data != nil {
+        t.Fatalf("expected no body, got %v, %v, %v", data, ok, err)
+    }
+}
+
+func TestBytesRead(t *testing.T) {
+    body := strings.Repeat("compressible ", 1000)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+            w.Header().Set("Content-Encoding", "gzip")
+            w.Write(gzipped(body))
+            return
+        }
+        w.Write([]byte(body))
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL)
+    if _, err := b.BytesRead(); err == nil {
+        t.Fatalf("expected an error before the request is made")
+    }
+    if s, err := b.AsString(); err != nil || s != body {
+        t.Fatalf("unexpected body, %v", err)
+    }
+    if n, err := b.BytesRead(); err != nil || n != int64(len(gzipped(body))) {
+        t.Fatalf("expected the %d compressed bytes, got %d, %v", len(gzipped(body)), n, err)
+    }
+    b = Get(ts.URL).DisableCompression()
+    b.AsBytes()
+    if n, err := b.BytesRead(); err != nil || n != int64(len(body)) {
+        t.Fatalf("expected %d bytes, got %d, %v", len(body), n, err)
+    }
+}
+
+func TestPathRewrite(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.Host + " " + r.RequestURI))
+    }))
+    defer ts.Close()
+
+    rewrite := func(path string) string {
+        return "/v2" + strings.TrimPrefix(path, "/public")
+    }
+    s, err := Get(ts.URL+"/public/a%20b").Param("q", "/public").PathRewrite(rewrite).AsString()
+    want := ts.Listener.Addr().String() + " /v2/a%20b?q=%2Fpublic"
+    if err != nil || s != want {
+        t.Fatalf("expected %q, got %q, %v", want, s, err)
+    }
+}
+
+func TestStreamJSON(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for i := 1; i <= 3; i++ {
+            fmt.Fprintf(w, "{\"n\":%d}\n", i)
+            w.(http.Flusher).Flush()
+            if i == 2 {
+                w.Write([]byte("\r\n"))
+            }
+        }
+        if r.URL.Path == "/bad" {
+            w.Write([]byte("not json\n"))
+        }
+    }))
+    defer ts.Close()
+
+    type event struct{ N int }
+    out := make(chan interface{})
+    errc := make(chan error, 1)
+    go func() { errc <- Get(ts.URL).StreamJSON(&event{}, out) }()
+    var got []int
+    for v := range out {
+        got = append(got, v.(*event).N)
+    }
+    if err := <-errc; err != nil || fmt.Sprint(got) != "[1 2 3]" {
+        t.Fatalf("unexpected events %v, %v", got, err)
+    }
+
+    out = make(chan interface{}, 10)
+    if err := Get(ts.URL+"/bad").StreamJSON(event{}, out); err == nil {
+        t.Fatalf("expected an error for a line that isn't JSON")
+    }
+    got = nil
+    for v := range out {
+        got = append(got, v.(event).N)
+    }
+    if fmt.Sprint(got) != "[1 2 3]" {
+        t.Fatalf("expected the values before the bad line, got %v", got)
+    }
+    out = make(chan interface{}, 10)
+    if err := Get(ts.URL).StreamJSON(nil, out); err != nil || len(out) != 3 {
+        t.Fatalf("expected 3 values, got %d, %v", len(out), err)
+    }
+    if m, ok := (<-out).(map[string]interface{}); !ok || m["n"] != 1.0 {
+        t.Fatalf("expected a map, got %v", m)
+    }
+}
+
+func TestExpectContentType(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/json":
+            w.Header().Set("Content-Type", "Application/JSON; charset=utf-8")
+            w.Write([]byte(`{"ok":true}`))
+        case "/none":
+            w.WriteHeader(204)
+        default:
+            w.Header().Set("Content-Type", "text/html")
+            w.Write([]byte("<html>" + strings.Repeat("maintenance ", 100) + "</html>"))
+        }
+    }))
+    defer ts.Close()
+
+    var v map[string]bool
+    if err := Get(ts.URL + "/json").ExpectContentType("application/json").AsJSON(&v); err != nil || !v["ok"] {
+        t.Fatalf("unexpected result %v, %v", v, err)
+    }
+    b := Get(ts.URL + "/html").ExpectContentType("application/json")
+    err := b.AsJSON(&v)
+    if err == nil || !strings.Contains(err.Error(), `"text/html"`) || !strings.Contains(err.Error(), "<html>maintenance") {
+        t.Fatalf("expected an error with the Content-Type and body, got %v", err)
+    }
+    if len(err.Error()) > 400 {
+        t.Fatalf("expected only the start of the body in the error, got %d bytes", len(err.Error()))
+    }
+    if status, err := b.StatusCode(); err != nil || status != 200 {
+        t.Fatalf("expected the status to be available, got %d, %v", status, err)
+    }
+    if _, err := Get(ts.URL + "/none").ExpectContentType("application/json").AsString(); err != nil {
+        t.Fatalf("expected a 204 to pass, got %v", err)
+    }
+}
+
+func TestCompressRequestAbove(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var body io.Reader = r.Body
+        if r.Header.Get("Content-Encoding") == "gzip" {
+            zr, err := gzip.NewReader(r.Body)
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            body = zr
+        }
+        data, _ := ioutil.ReadAll(body)
+        fmt.Fprintf(w, "%s %d %d %s", r.Header.Get("Content-Encoding"), r.ContentLength, len(data), data[:5])
+    }))
+    defer ts.Close()
+
+    large := strings.Repeat("large", 1000)
+    s, err := Post(ts.URL).CompressRequestAbove(1024).Body(large).AsString()
+    if err != nil || !strings.HasPrefix(s, "gzip ") || !strings.HasSuffix(s, " 5000 large") {
+        t.Fatalf("expected a compressed body, got %q, %v", s, err)
+    }
+    if n, _ := strconv.Atoi(strings.Fields(s)[1]); n <= 0 || n >= 5000 {
+        t.Fatalf("expected the Content-Length of the compressed body, got %q", s)
+    }
+    s, err = Post(ts.URL).CompressRequestAbove(1024).Body("small").AsString()
+    if err != nil || s != " 5 5 small" {
+        t.Fatalf("expected a small body to be sent as is, got %q, %v", s, err)
+    }
+    s, err = Post(ts.URL).CompressRequestAbove(1024).Body(strings.NewReader(large)).AsString()
+    if err != nil || !strings.HasPrefix(s, "gzip ") || !strings.HasSuffix(s, " 5000 large") {
+        t.Fatalf("expected a reader body to be buffered and compressed, got %q, %v", s, err)
+    }
+    _, err = Post(ts.URL).CompressRequestAbove(1024).MaxBodySize(2048).Body(strings.NewReader(large)).AsString()
+    if err != ErrBodyTooLarge {
+        t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+    }
+}
+
+func TestServerName(t *testing.T) {
+    // the test certificate is valid for example.com
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+    }))
+    ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+    defer ts.Close()
+    addr := ts.Listener.Addr().String()
+
+    s, err := Get("https://" + addr).TLSConfig(trustServer(ts)).ServerName("www.example.com").AsString()
+    if err != nil || s != addr+" www.example.com" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    _, err = Get("https://" + addr).TLSConfig(trustServer(ts)).ServerName("other.test").AsString()
+    if err == nil || !strings.Contains(err.Error(), "other.test") {
+        t.Fatalf("expected the certificate to be checked against the server name, got %v", err)
+    }
+}
+
+func TestAbsoluteURI(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.RequestURI + " " + r.Host))
+    }))
+    defer ts.Close()
+    host := ts.Listener.Addr().String()
+
+    s, err := Get(ts.URL + "/a%20b").Param("q", "1").AbsoluteURI().AsString()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "http://" + host + "/a%20b?q=1 " + host; s != want {
+        t.Fatalf("expected %q, got %q", want, s)
+    }
+    s, err = new(Client).Get(ts.URL + "/pooled").AbsoluteURI().AsString()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "http://" + host + "/pooled " + host; s != want {
+        t.Fatalf("expected %q, got %q", want, s)
+    }
+    s, err = Get(ts.URL + "/origin").AsString()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "/origin " + host; s != want {
+        t.Fatalf("expected %q, got %q", want, s)
+    }
+}
+
+func TestRawChunks(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    accepted := make(chan bool, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            accepted <- true
+            go func() {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for {
+                    req, err := http.ReadRequest(r)
+                    if err != nil {
+                        return
+                    }
+                    if req.URL.Path == "/plain" {
+                        io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nplain")
+                        continue
+                    }
+                    io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+                        "5;sig=abc\r\nhello\r\n"+
+                        "6;a=1;b=\"x y\"\r\n world\r\n"+
+                        "0;last\r\nX-Checksum: 42\r\nX-Extra: 1\r\n\r\n")
+                }
+            }()
+        }
+    }()
+    url := "http://" + l.Addr().String()
+
+    c := new(Client)
+    defer c.Close()
+    b := c.Get(url).RawChunks()
+    s, err := b.AsString()
+    if err != nil || s != "hello world" {
+        t.Fatalf("expected the chunked body, got %q, %v", s, err)
+    }
+    chunks, err := b.Chunks()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []Chunk{{5, "sig=abc"}, {6, `a=1;b="x y"`}, {0, "last"}}
+    if fmt.Sprint(chunks) != fmt.Sprint(want) {
+        t.Fatalf("expected chunks %v, got %v", want, chunks)
+    }
+    if v, _ := b.Trailer("X-Checksum"); v != "42" {
+        t.Fatalf("expected the declared trailer, got %q", v)
+    }
+    if v, _ := b.Trailer("X-Extra"); v != "1" {
+        t.Fatalf("expected the undeclared trailer, got %q", v)
+    }
+
+    b = c.Get(url + "/plain").RawChunks()
+    if s, err := b.AsString(); err != nil || s != "plain" {
+        t.Fatalf("expected the plain body, got %q, %v", s, err)
+    }
+    if chunks, err := b.Chunks(); err != nil || chunks != nil {
+        t.Fatalf("expected no chunks for a plain body, got %v, %v", chunks, err)
+    }
+    if s, err := c.Get(url).AsString(); err != nil || s != "hello world" {
+        t.Fatalf("expected the chunked body without RawChunks, got %q, %v", s, err)
+    }
+    if len(accepted) != 1 {
+        t.Fatalf("expected the connection to be reused, got %d connections", len(accepted))
+    }
+}
+
+func TestToCurl(t *testing.T) {
+    cmd, err := Post("http://example.com/api").Param("q", "it's").
+        Header("Authorization", "Bearer secret").ToCurl()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `curl -X 'POST' -H 'Authorization: REDACTED' -H 'Content-Type: application/x-www-form-urlencoded' ` +
+        `-H 'User-Agent: httplib.go' --compressed --data-binary 'q=it%27s' 'http://example.com/api'`
+    if cmd != want {
+        t.Fatalf("expected\n%s\ngot\n%s", want, cmd)
+    }
+
+    cmd, err = Get("http://example.com/search").Param("q", "a b").Header("Authorization", "Bearer secret").
+        Header("X-Note", "it's").DisableCompression().ToCurlWithAuth()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want = `curl -H 'Authorization: Bearer secret' -H 'User-Agent: httplib.go' -H 'X-Note: it'\''s' ` +
+        `'http://example.com/search?q=a+b'`
+    if cmd != want {
+        t.Fatalf("expected\n%s\ngot\n%s", want, cmd)
+    }
+
+    cmd, err = Put("http://example.com/blob").Body([]byte{'a', 0, '\'', 0xff}).DisableCompression().ToCurl()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want = `curl -X 'PUT' -H 'User-Agent: httplib.go' --data-binary $'a\x00\'\xff' 'http://example.com/blob'`; cmd != want {
+        t.Fatalf("expected\n%s\ngot\n%s", want, cmd)
+    }
+
+    if _, err := Post("http://example.com/").Body(strings.NewReader("data")).ToCurl(); err == nil {
+        t.Fatalf("expected an error for a body from a reader")
+    }
+}
+
+func TestDecompressedHeaders(t *testing.T) {
+    body := strings.Repeat("decoded text ", 100)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var buf bytes.Buffer
+        var zw io.WriteCloser
+        switch r.URL.Path {
+        case "/gzip":
+            w.Header().Set("Content-Encoding", "gzip")
+            zw = gzip.NewWriter(&buf)
+        case "/zlib":
+            w.Header().Set("Content-Encoding", "deflate")
+            zw = zlib.NewWriter(&buf)
+        case "/raw":
+            // raw deflate data, as some servers send
+            w.Header().Set("Content-Encoding", "Deflate")
+            zw, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+        }
+        zw.Write([]byte(body))
+        zw.Close()
+        w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+        w.Write(buf.Bytes())
+    }))
+    defer ts.Close()
+
+    for _, path := range []string{"/gzip", "/zlib", "/raw"} {
+        resp, err := Get(ts.URL + path).AsResponse()
+        if err != nil {
+            t.Fatalf("%s: request failed: %s", path, err.Error())
+        }
+        data, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil || string(data) != body {
+            t.Fatalf("%s: expected the decompressed body, got %q, %v", path, data, err)
+        }
+        if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+            t.Fatalf("%s: expected Content-Encoding to be removed, got %q", path, encoding)
+        }
+        if length := resp.Header.Get("Content-Length"); length != "" {
+            t.Fatalf("%s: expected the Content-Length of the compressed body to be removed, got %q", path, length)
+        }
+        if resp.ContentLength != -1 || !resp.Uncompressed {
+            t.Fatalf("%s: expected an unknown length and Uncompressed, got %d, %v", path, resp.ContentLength, resp.Uncompressed)
+        }
+    }
+
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    b := Get(ts.URL + "/zlib").Header("Accept-Encoding", "deflate").DecompressToFile()
+    if err := b.AsFile(filepath.Join(dir, "out")); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := ioutil.ReadFile(filepath.Join(dir, "out")); string(data) != body {
+        t.Fatalf("expected the decompressed file, got %q", data)
+    }
+    header, _ := b.ResponseHeaderMap()
+    if header.Get("Content-Encoding") != "" || header.Get("Content-Length") != "" {
+        t.Fatalf("expected the headers of the decompressed file, got %v", header)
+    }
+}
+
+func TestValidate(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Signature", "good")
+        w.Write([]byte("signed"))
+    }))
+    defer ts.Close()
+
+    var order []string
+    validator := func(name, header string) func(*http.Response) error {
+        return func(resp *http.Response) error {
+            order = append(order, name)
+            if resp.Header.Get(header) == "" {
+                return errors.New("missing " + header)
+            }
+            return nil
+        }
+    }
+    s, err := Get(ts.URL).Validate(validator("a", "X-Signature")).Validate(validator("b", "Content-Type")).AsString()
+    if err != nil || s != "signed" || strings.Join(order, ",") != "a,b" {
+        t.Fatalf("expected both validators to pass, got %q, %v, %v", s, err, order)
+    }
+    order = nil
+    b := Get(ts.URL).Validate(validator("a", "X-Missing")).Validate(validator("b", "X-Signature"))
+    if _, err := b.AsString(); err == nil || err.Error() != "missing X-Missing" {
+        t.Fatalf("expected the error of the validator, got %v", err)
+    }
+    if strings.Join(order, ",") != "a" {
+        t.Fatalf("expected the first error to stop the validators, got %v", order)
+    }
+    if code, _ := b.StatusCode(); code != 200 {
+        t.Fatalf("expected the status code to be kept, got %d", code)
+    }
+}
+
+func TestRetryBrokenUpload(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    conns := make(chan bool, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            conns <- true
+            if len(conns)%2 == 1 {
+                // drop the connection partway through the upload
+                io.ReadFull(conn, make([]byte, 64<<10))
+                conn.(*net.TCPConn).SetLinger(0)
+                conn.Close()
+                continue
+            }
+            go func() {
+                defer conn.Close()
+                req, err := http.ReadRequest(bufio.NewReader(conn))
+                if err != nil {
+                    return
+                }
+                n, _ := io.Copy(ioutil.Discard, req.Body)
+                fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%d", len(strconv.Itoa(int(n))), n)
+            }()
+        }
+    }()
+    url := "http://" + l.Addr().String()
+    body := make([]byte, 4<<20)
+
+    s, err := Post(url).Body(body).Retry(1, time.Millisecond).AsString()
+    if err != nil || s != strconv.Itoa(len(body)) {
+        t.Fatalf("expected the upload to be sent again in full, got %q, %v", s, err)
+    }
+    if len(conns) != 2 {
+        t.Fatalf("expected a new connection for the retry, got %d connections", len(conns))
+    }
+
+    // a body from a reader can't be sent again
+    for len(conns) > 0 {
+        <-conns
+    }
+    _, err = Post(url).Body(bytes.NewReader(body)).Retry(1, time.Millisecond).AsString()
+    if err == nil || len(conns) != 1 {
+        t.Fatalf("expected the error without a retry, got %v after %d connections", err, len(conns))
+    }
+    <-conns
+    s, err = Post(url).Body(bytes.NewReader(body)).BufferBody().Retry(1, time.Millisecond).AsString()
+    if err != nil || s != strconv.Itoa(len(body)) || len(conns) != 2 {
+        t.Fatalf("expected a buffered upload to be sent again in full, got %q, %v", s, err)
+    }
+}
+
+func TestFinalRequest(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/start" {
+            http.Redirect(w, r, "/final?step=2", http.StatusFound)
+        }
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL+"/start").FollowRedirects(5).Header("Authorization", "Bearer secret").Header("X-Trace", "1").
+        RedactHeaders("authorization")
+    req, err := b.FinalRequest()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if req.Method != "GET" || req.URL.String() != ts.URL+"/final?step=2" {
+        t.Fatalf("expected the redirected request, got %s %s", req.Method, req.URL)
+    }
+    if req.Header.Get("Authorization") != "REDACTED" || req.Header.Get("X-Trace") != "1" {
+        t.Fatalf("expected Authorization to be redacted, got %v", req.Header)
+    }
+    if b.req.Header.Get("Authorization") != "Bearer secret" {
+        t.Fatalf("expected the builder to keep the header")
+    }
+
+    req, err = Put(ts.URL + "/item").MethodOverride("").FinalRequest()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if req.Method != "POST" || req.Header.Get("X-HTTP-Method-Override") != "PUT" || req.URL.Path != "/item" {
+        t.Fatalf("expected the request as sent, got %s %s %v", req.Method, req.URL, req.Header)
+    }
+}
+
+func TestTruncatedBody(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+                    return
+                }
+                io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")
+            }()
+        }
+    }()
+    url := "http://" + l.Addr().String()
+
+    for _, b := range []*HttpRequestBuilder{Get(url), Get(url).RawChunks()} {
+        _, err := b.AsBytes()
+        terr, ok := err.(*TruncatedError)
+        if !ok || terr.Read != 5 || terr.ContentLength != 10 {
+            t.Fatalf("expected a TruncatedError after 5 of 10 bytes, got %v", err)
+        }
+        if !errors.Is(err, io.ErrUnexpectedEOF) {
+            t.Fatalf("expected the error to unwrap to io.ErrUnexpectedEOF")
+        }
+    }
+    s, err := Get(url).AllowTruncatedBody().AsString()
+    if err != nil || s != "hello" {
+        t.Fatalf("expected the short body with AllowTruncatedBody, got %q, %v", s, err)
+    }
+}
+
+func TestPing(t *testing.T) {
+    hang := make(chan bool)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "HEAD" {
+            t.Errorf("expected a HEAD request, got %s", r.Method)
+        }
+        if r.URL.Path == "/hang" {
+            <-hang
+        }
+        w.WriteHeader(503)
+    }))
+    defer ts.Close()
+    defer close(hang)
+
+    if err := Ping(ts.URL, time.Second); err != nil {
+        t.Fatalf("expected an error status to count as reachable, got %v", err)
+    }
+    if err := Ping(ts.URL+"/hang", 50*time.Millisecond); err == nil {
+        t.Fatalf("expected a server that doesn't answer in time to fail")
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Close()
+    if err := Ping("http://"+l.Addr().String(), time.Second); err == nil {
+        t.Fatalf("expected a closed port to fail")
+    }
+}
+
+func TestAcceptHeaders(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Language", r.Header.Get("Accept-Language"))
+        if r.Header.Get("Accept-Encoding") == "identity, gzip;q=0.5" {
+            w.Header().Set("Content-Encoding", "gzip")
+            w.Write(gzipped("hello"))
+            return
+        }
+        w.Write([]byte(r.Header.Get("Accept-Encoding")))
+    }))
+    defer ts.Close()
+
+    b := Get(ts.URL).AcceptLanguage("fr-CH", "fr;q=0.9", "en;q=0.8")
+    resp, err := b.AsResponse()
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if lang := resp.Header.Get("Content-Language"); lang != "fr-CH, fr;q=0.9, en;q=0.8" {
+        t.Fatalf("unexpected Accept-Language %q", lang)
+    }
+    s, err := Get(ts.URL).AcceptEncoding("identity", "gzip;q=0.5").AsString()
+    if err != nil || s != string(gzipped("hello")) {
+        t.Fatalf("expected the response to be left compressed, got %q, %v", s, err)
+    }
+    if _, err := Get(ts.URL).AcceptLanguage("en\r\nX-Injected: 1").AsString(); err == nil {
+        t.Fatalf("expected a header injection to fail")
+    }
+}
+
 /*
 func TestInvalid(t *testing.T) {
         _,err := Post("http://invalidurlsdfsdfasdfsdgf:9999/post").AsString()
@@ -0,0 +1,78 @@
+package httplib
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// MockTransport answers requests with canned responses by URL, for testing
+// code built on the library without a server or network access. Set it on
+// a request with Transport, or on a Client. Requests for a URL without a
+// response fail. A MockTransport is safe for concurrent use.
+type MockTransport struct {
+    mu        sync.Mutex
+    responses map[string]mockResponse
+    requests  []*http.Request
+}
+
+type mockResponse struct {
+    status int
+    header http.Header
+    body   string
+}
+
+// NewMockTransport returns a MockTransport without any responses.
+func NewMockTransport() *MockTransport {
+    return &MockTransport{responses: map[string]mockResponse{}}
+}
+
+// Respond makes requests for url, any method, get a response with the given
+// status, headers and body. url must match the request URL exactly, with its
+// query string. header may be nil.
+func (m *MockTransport) Respond(url string, status int, header http.Header, body string) *MockTransport {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.responses[url] = mockResponse{status, header.Clone(), body}
+    return m
+}
+
+// Requests returns the requests received so far, in order, without their
+// bodies.
+func (m *MockTransport) Requests() []*http.Request {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return append([]*http.Request(nil), m.requests...)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.Body != nil {
+        ioutil.ReadAll(req.Body)
+        req.Body.Close()
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.requests = append(m.requests, sentRequest(req))
+    r, ok := m.responses[req.URL.String()]
+    if !ok {
+        return nil, fmt.Errorf("httplib: no mock response for %s %s", req.Method, req.URL)
+    }
+    header := r.header.Clone()
+    if header == nil {
+        header = http.Header{}
+    }
+    return &http.Response{
+        Status:        fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+        StatusCode:    r.status,
+        Proto:         "HTTP/1.1",
+        ProtoMajor:    1,
+        ProtoMinor:    1,
+        Header:        header,
+        Body:          ioutil.NopCloser(strings.NewReader(r.body)),
+        ContentLength: int64(len(r.body)),
+        Request:       req,
+    }, nil
+}
@@ -0,0 +1,51 @@
+package httplib
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestMockTransport(t *testing.T) {
+    m := NewMockTransport().
+        Respond("http://api.test/items?page=1", 200, http.Header{"Content-Type": {"application/json"}}, `[{"name":"go"}]`).
+        Respond("http://api.test/old", 301, http.Header{"Location": {"/items?page=1"}}, "").
+        Respond("http://api.test/busy", 503, nil, "")
+
+    var items []struct{ Name string }
+    if err := Get("http://api.test/items").Param("page", "1").Transport(m).AsJSON(&items); err != nil {
+        t.Fatal(err)
+    }
+    if len(items) != 1 || items[0].Name != "go" {
+        t.Fatalf("unexpected items %+v", items)
+    }
+    c := &Client{Transport: m}
+    s, err := c.Get("http://api.test/old").FollowRedirects(1).AsString()
+    if err != nil || !strings.Contains(s, "go") {
+        t.Fatalf("expected the redirect to be followed, got %q, %v", s, err)
+    }
+    status, err := c.Post("http://api.test/busy").Body("data").Retry(2, 0).StatusCode()
+    if err != nil || status != 503 {
+        t.Fatalf("expected the canned status, got %d, %v", status, err)
+    }
+    if _, err := c.Get("http://api.test/missing").AsString(); err == nil {
+        t.Fatalf("expected an error for a URL without a response")
+    }
+
+    reqs := m.Requests()
+    var got []string
+    for _, req := range reqs {
+        got = append(got, req.Method+" "+req.URL.String())
+    }
+    want := "GET http://api.test/items?page=1,GET http://api.test/old,GET http://api.test/items?page=1," +
+        "POST http://api.test/busy,POST http://api.test/busy,POST http://api.test/busy,GET http://api.test/missing"
+    if strings.Join(got, ",") != want {
+        t.Fatalf("unexpected requests:\n%s", strings.Join(got, "\n"))
+    }
+
+    var statusErr *StatusError
+    if _, err := Get("http://api.test/busy").Transport(m).CheckStatus().AsString(); !errors.As(err, &statusErr) {
+        t.Fatalf("expected a StatusError, got %v", err)
+    }
+}
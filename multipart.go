@@ -0,0 +1,207 @@
+package httplib
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// formFile is a file to upload in a multipart/form-data body, read from
+// path or, if that's empty, held in data.
+type formFile struct {
+    field    string
+    filename string
+    path     string
+    data     []byte
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// formSegment is a run of a multipart body, either data in memory or the
+// first size bytes of the file at path.
+type formSegment struct {
+    data []byte
+    path string
+    size int64
+}
+
+// multipartBody is a multipart/form-data body laid out as segments, so that
+// its length is known up front and files are streamed from disk as it is
+// sent rather than buffered.
+type multipartBody struct {
+    contentType string
+    segments    []formSegment
+    length      int64
+}
+
+// newMultipartBody lays out a body with the key and value pairs of fields
+// followed by files, whose sizes are taken from the file system.
+func newMultipartBody(fields [][2]string, files []formFile) (*multipartBody, error) {
+    var buf bytes.Buffer
+    w := multipart.NewWriter(&buf)
+    m := &multipartBody{contentType: w.FormDataContentType()}
+
+    for _, field := range fields {
+        if err := w.WriteField(field[0], field[1]); err != nil {
+            return nil, err
+        }
+    }
+    for _, f := range files {
+        if f.path == "" {
+            h := textproto.MIMEHeader{}
+            h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+                quoteEscaper.Replace(f.field), quoteEscaper.Replace(f.filename)))
+            h.Set("Content-Type", http.DetectContentType(f.data))
+            part, err := w.CreatePart(h)
+            if err != nil {
+                return nil, err
+            }
+            if _, err := part.Write(f.data); err != nil {
+                return nil, err
+            }
+            continue
+        }
+        fi, err := os.Stat(f.path)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := w.CreateFormFile(f.field, f.filename); err != nil {
+            return nil, err
+        }
+        m.add(formSegment{data: append([]byte(nil), buf.Bytes()...)})
+        buf.Reset()
+        m.add(formSegment{path: f.path, size: fi.Size()})
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    m.add(formSegment{data: buf.Bytes()})
+    return m, nil
+}
+
+func (m *multipartBody) add(segment formSegment) {
+    if segment.path == "" {
+        segment.size = int64(len(segment.data))
+    }
+    m.segments = append(m.segments, segment)
+    m.length += segment.size
+}
+
+// open returns a reader over the body, which opens each file as it gets to
+// it.
+func (m *multipartBody) open() io.ReadCloser {
+    return &formReader{segments: m.segments}
+}
+
+type formReader struct {
+    segments []formSegment
+    cur      io.Reader
+    left     int64
+    file     *os.File
+}
+
+func (r *formReader) Read(p []byte) (int, error) {
+    for {
+        if r.cur == nil {
+            if len(r.segments) == 0 {
+                return 0, io.EOF
+            }
+            segment := r.segments[0]
+            r.segments = r.segments[1:]
+            if segment.path == "" {
+                r.cur = bytes.NewReader(segment.data)
+            } else {
+                f, err := os.Open(segment.path)
+                if err != nil {
+                    return 0, err
+                }
+                r.file = f
+                r.cur = io.LimitReader(f, segment.size)
+            }
+            r.left = segment.size
+        }
+        n, err := r.cur.Read(p)
+        r.left -= int64(n)
+        if err == io.EOF {
+            r.Close()
+            r.cur = nil
+            // a file that shrank since it was measured would make the body
+            // shorter than its Content-Length
+            if r.left > 0 {
+                return n, io.ErrUnexpectedEOF
+            }
+            if n == 0 {
+                continue
+            }
+            err = nil
+        }
+        return n, err
+    }
+}
+
+func (r *formReader) Close() error {
+    if r.file == nil {
+        return nil
+    }
+    err := r.file.Close()
+    r.file = nil
+    return err
+}
+
+// File uploads the file at path as the form field fieldname, making the
+// body multipart/form-data with any params as the other fields. It can be
+// called once per file. The body is sent with a Content-Length, worked out
+// from the file sizes, while the files are streamed from disk.
+func (b *HttpRequestBuilder) File(fieldname, path string) *HttpRequestBuilder {
+    b.files = append(b.files, formFile{field: fieldname, filename: filepath.Base(path), path: path})
+    b.body = nil
+    b.bodyFile = ""
+    b.bodyReader = nil
+    return b
+}
+
+// FileBytes uploads data as a file named filename in the form field
+// fieldname, like File but without it having to be on disk. Its
+// Content-Type is sniffed from the data. It can be mixed with File and
+// params.
+func (b *HttpRequestBuilder) FileBytes(fieldname, filename string, data []byte) *HttpRequestBuilder {
+    b.files = append(b.files, formFile{field: fieldname, filename: filename, data: data})
+    b.body = nil
+    b.bodyFile = ""
+    b.bodyReader = nil
+    return b
+}
+
+// progressReader reports the bytes read so far from a body of total bytes to
+// cb as it is sent.
+type progressReader struct {
+    io.ReadCloser
+    sent, total int64
+    cb          func(sent, total int64)
+    done        bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+    n, err := r.ReadCloser.Read(p)
+    r.sent += int64(n)
+    if n > 0 || err == io.EOF && !r.done {
+        r.done = r.sent == r.total
+        r.cb(r.sent, r.total)
+    }
+    return n, err
+}
+
+// UploadProgress calls cb as a multipart body made with File is sent, with
+// the bytes sent so far and the length of the body, and a final time with
+// sent equal to total once all of it has been sent. It starts over from zero
+// if the body is sent again, on a retry or redirect.
+func (b *HttpRequestBuilder) UploadProgress(cb func(sent, total int64)) *HttpRequestBuilder {
+    b.uploadProgress = cb
+    return b
+}
@@ -0,0 +1,163 @@
+package httplib
+
+import (
+    "bytes"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestFile(t *testing.T) {
+    type upload struct {
+        length, read     int64
+        chunked          bool
+        fields, filename map[string]string
+    }
+    var got upload
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        got = upload{
+            length:   r.ContentLength,
+            read:     int64(len(body)),
+            chunked:  len(r.TransferEncoding) > 0,
+            fields:   map[string]string{},
+            filename: map[string]string{},
+        }
+        _, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+        mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+        for {
+            part, err := mr.NextPart()
+            if err != nil {
+                break
+            }
+            data, _ := ioutil.ReadAll(part)
+            got.fields[part.FormName()] = string(data)
+            got.filename[part.FormName()] = part.FileName()
+        }
+    }))
+    defer ts.Close()
+
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    small := filepath.Join(dir, "small.txt")
+    large := filepath.Join(dir, "large.bin")
+    ioutil.WriteFile(small, []byte("hello"), 0644)
+    ioutil.WriteFile(large, []byte(strings.Repeat("0123456789", 100000)), 0644)
+
+    _, err = Post(ts.URL).Param("name", "go").File("a", small).File("b", large).AsString()
+    if err != nil {
+        t.Fatalf("upload failed: %s", err.Error())
+    }
+    if got.chunked || got.length != got.read {
+        t.Fatalf("expected a Content-Length of the bytes written, got %d for %d bytes (chunked %v)", got.length, got.read, got.chunked)
+    }
+    if got.fields["name"] != "go" || got.fields["a"] != "hello" || len(got.fields["b"]) != 1000000 {
+        t.Fatalf("unexpected form fields %q, %q and %d bytes", got.fields["name"], got.fields["a"], len(got.fields["b"]))
+    }
+    if got.filename["a"] != "small.txt" || got.filename["b"] != "large.bin" {
+        t.Fatalf("unexpected file names %v", got.filename)
+    }
+
+    got = upload{}
+    if _, err := Post(ts.URL).Body(strings.NewReader("reader")).File("a", small).AsString(); err != nil || got.fields["a"] != "hello" {
+        t.Fatalf("expected File to replace a reader body, got fields %v, %v", got.fields, err)
+    }
+
+    if _, err := Post(ts.URL).File("a", filepath.Join(dir, "missing")).AsString(); err == nil {
+        t.Fatalf("expected an error for a missing file")
+    }
+}
+
+func TestFileBytes(t *testing.T) {
+    type part struct{ filename, contentType, data string }
+    parts := map[string]part{}
+    var length, read int64
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        length, read = r.ContentLength, int64(len(body))
+        _, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+        mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+        for {
+            p, err := mr.NextPart()
+            if err != nil {
+                break
+            }
+            data, _ := ioutil.ReadAll(p)
+            parts[p.FormName()] = part{p.FileName(), p.Header.Get("Content-Type"), string(data)}
+        }
+    }))
+    defer ts.Close()
+
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "disk.txt")
+    ioutil.WriteFile(path, []byte("from disk"), 0644)
+
+    _, err = Post(ts.URL).Param("name", "go").
+        FileBytes("csv", "report.csv", []byte("a,b\n1,2\n")).
+        File("disk", path).
+        FileBytes("page", `say "hi".html`, []byte("<html><body>hi</body></html>")).
+        AsString()
+    if err != nil {
+        t.Fatalf("upload failed: %s", err.Error())
+    }
+    if length != read {
+        t.Fatalf("expected a Content-Length of %d, got %d", read, length)
+    }
+    for field, want := range map[string]part{
+        "name": {"", "", "go"},
+        "csv":  {"report.csv", "text/plain; charset=utf-8", "a,b\n1,2\n"},
+        "disk": {"disk.txt", "application/octet-stream", "from disk"},
+        "page": {`say "hi".html`, "text/html; charset=utf-8", "<html><body>hi</body></html>"},
+    } {
+        if parts[field] != want {
+            t.Errorf("%s: expected %+v, got %+v", field, want, parts[field])
+        }
+    }
+
+    parts = map[string]part{}
+    _, err = Post(ts.URL).Body(strings.NewReader("reader")).FileBytes("csv", "report.csv", []byte("a,b\n")).AsString()
+    if err != nil || parts["csv"].data != "a,b\n" {
+        t.Fatalf("expected FileBytes to replace a reader body, got %+v, %v", parts, err)
+    }
+}
+
+func TestUploadProgress(t *testing.T) {
+    ts := echoServer()
+    defer ts.Close()
+    dir, err := ioutil.TempDir("", "httplib")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "large.bin")
+    ioutil.WriteFile(path, []byte(strings.Repeat("0123456789", 100000)), 0644)
+
+    var calls int
+    var last, total int64 = -1, -1
+    _, err = Post(ts.URL).File("f", path).UploadProgress(func(sent, n int64) {
+        if sent < last || total != -1 && n != total {
+            t.Errorf("unexpected progress %d of %d after %d of %d", sent, n, last, total)
+        }
+        calls++
+        last, total = sent, n
+    }).AsString()
+    if err != nil {
+        t.Fatalf("upload failed: %s", err.Error())
+    }
+    if calls < 2 || last != total || total < 1000000 {
+        t.Fatalf("expected progress ending in sent == total, got %d calls ending at %d of %d", calls, last, total)
+    }
+}
@@ -0,0 +1,313 @@
+package httplib
+
+import (
+    "bufio"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// getenv returns the first of the environment variables that is set.
+func getenv(names ...string) string {
+    for _, name := range names {
+        if value := os.Getenv(name); value != "" {
+            return value
+        }
+    }
+    return ""
+}
+
+// proxyFromEnvironment returns the proxy for requests to target from the
+// http_proxy or https_proxy environment variables, depending on its scheme,
+// or nil if it should be reached directly. Hosts listed in no_proxy are
+// reached directly, as are localhost and loopback addresses.
+func proxyFromEnvironment(target *url.URL) (*url.URL, error) {
+    var rawProxy string
+    if target.Scheme == "https" {
+        rawProxy = getenv("https_proxy", "HTTPS_PROXY")
+    } else if os.Getenv("REQUEST_METHOD") != "" {
+        // under CGI a Proxy request header arrives as HTTP_PROXY, httpoxy
+        rawProxy = getenv("http_proxy")
+    } else {
+        rawProxy = getenv("http_proxy", "HTTP_PROXY")
+    }
+    if rawProxy == "" || noProxy(target.Hostname(), target.Port(), getenv("no_proxy", "NO_PROXY")) {
+        return nil, nil
+    }
+    proxy, err := parseURL(rawProxy)
+    if err != nil || proxy.Host == "" {
+        return nil, fmt.Errorf("httplib: invalid proxy address %q", rawProxy)
+    }
+    if proxy.Scheme != "http" {
+        return nil, fmt.Errorf("httplib: unsupported proxy scheme %q", proxy.Scheme)
+    }
+    return proxy, nil
+}
+
+// proxy returns the http proxy for requests to target, from the
+// environment if the options say so.
+func (o *connOptions) proxy(target *url.URL) (*url.URL, error) {
+    if o == nil || !o.envProxy {
+        return nil, nil
+    }
+    return proxyFromEnvironment(target)
+}
+
+// noProxy reports whether host, with the given port, is exempt from the
+// proxy by the comma separated no_proxy list. An entry is "*" for every
+// host, an IP address, a CIDR range such as 10.0.0.0/8, or a domain that
+// also covers its subdomains, written as example.com, .example.com or
+// *.example.com. Entries other than CIDR ranges may end in a port to only
+// apply to it.
+func noProxy(host, port, list string) bool {
+    host = strings.ToLower(host)
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    if ip != nil && ip.IsLoopback() {
+        return true
+    }
+    for _, entry := range strings.Split(strings.ToLower(list), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if entry == "*" {
+            return true
+        }
+        if _, cidr, err := net.ParseCIDR(entry); err == nil {
+            if ip != nil && cidr.Contains(ip) {
+                return true
+            }
+            continue
+        }
+        if h, p, err := net.SplitHostPort(entry); err == nil {
+            if p != port {
+                continue
+            }
+            entry = h
+        }
+        entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+        if entryIP := net.ParseIP(entry); entryIP != nil {
+            if ip != nil && entryIP.Equal(ip) {
+                return true
+            }
+            continue
+        }
+        if host == entry || strings.HasSuffix(host, "."+entry) {
+            return true
+        }
+    }
+    return false
+}
+
+// proxyAddr returns the address to dial for proxy.
+func proxyAddr(proxy *url.URL) string {
+    if proxy.Port() != "" {
+        return proxy.Host
+    }
+    return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// proxyAuth returns the Proxy-Authorization header for the credentials in
+// the proxy URL, if it has any.
+func proxyAuth(proxy *url.URL) string {
+    if proxy.User == nil {
+        return ""
+    }
+    password, _ := proxy.User.Password()
+    credentials := proxy.User.Username() + ":" + password
+    return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// connectTunnel asks proxy, over conn, to tunnel it to addr with CONNECT,
+// for https requests.
+func connectTunnel(conn net.Conn, proxy *url.URL, addr string) error {
+    req := &http.Request{
+        Method: "CONNECT",
+        URL:    &url.URL{Opaque: addr},
+        Host:   addr,
+        Header: http.Header{"User-Agent": {defaultUserAgent}},
+    }
+    if auth := proxyAuth(proxy); auth != "" {
+        req.Header.Set("Proxy-Authorization", auth)
+    }
+    if err := req.Write(conn); err != nil {
+        return err
+    }
+    resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != 200 {
+        return fmt.Errorf("httplib: proxy refused CONNECT to %s: %s", addr, resp.Status)
+    }
+    return nil
+}
+
+// proxyRequest returns a copy of req to send to an http proxy, which takes
+// the absolute URL in the request line.
+func proxyRequest(req *http.Request, proxy *url.URL) *http.Request {
+    out := *req
+    u := *req.URL
+    absoluteForm(&u)
+    out.URL = &u
+    if auth := proxyAuth(proxy); auth != "" {
+        out.Header = req.Header.Clone()
+        out.Header.Set("Proxy-Authorization", auth)
+    }
+    return &out
+}
+
+// absoluteForm makes u write as an absolute URL in a request line, which
+// otherwise has only its path and query.
+func absoluteForm(u *url.URL) {
+    u.Opaque = "//" + u.Host + u.EscapedPath()
+}
+
+// socks5Dialer connects through a SOCKS5 proxy, RFC 1928, with optional
+// username and password authentication, RFC 1929. Target hostnames are
+// resolved by the proxy.
+type socks5Dialer struct {
+    addr     string
+    user     string
+    password string
+    forward  Dialer
+}
+
+var socks5Errors = []string{
+    1: "general SOCKS server failure",
+    2: "connection not allowed by ruleset",
+    3: "network unreachable",
+    4: "host unreachable",
+    5: "connection refused",
+    6: "TTL expired",
+    7: "command not supported",
+    8: "address type not supported",
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+    forward := d.forward
+    if forward == nil {
+        forward = defaultDialer
+    }
+    conn, err := forward.Dial(network, d.addr)
+    if err != nil {
+        return nil, err
+    }
+    if err := d.connect(conn, addr); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return conn, nil
+}
+
+// connect runs the SOCKS5 handshake over conn, leaving it connected to addr.
+func (d *socks5Dialer) connect(conn net.Conn, addr string) error {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil || port < 0 || port > 65535 {
+        return fmt.Errorf("httplib: invalid port in %q", addr)
+    }
+
+    methods := []byte{0}
+    if d.user != "" {
+        methods = []byte{0, 2}
+    }
+    if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+        return err
+    }
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return err
+    }
+    if reply[0] != 5 {
+        return fmt.Errorf("httplib: unexpected SOCKS version %d", reply[0])
+    }
+    switch reply[1] {
+    case 0:
+    case 2:
+        if d.user == "" {
+            return errors.New("httplib: SOCKS5 proxy asked for credentials")
+        }
+        if len(d.user) > 255 || len(d.password) > 255 {
+            return errors.New("httplib: SOCKS5 username or password too long")
+        }
+        auth := []byte{1, byte(len(d.user))}
+        auth = append(auth, d.user...)
+        auth = append(auth, byte(len(d.password)))
+        auth = append(auth, d.password...)
+        if _, err := conn.Write(auth); err != nil {
+            return err
+        }
+        if _, err := io.ReadFull(conn, reply); err != nil {
+            return err
+        }
+        if reply[1] != 0 {
+            return errors.New("httplib: SOCKS5 proxy rejected the username and password")
+        }
+    default:
+        return errors.New("httplib: SOCKS5 proxy accepts none of the authentication methods offered")
+    }
+
+    req := []byte{5, 1, 0}
+    if ip := net.ParseIP(host); ip == nil {
+        if len(host) > 255 {
+            return fmt.Errorf("httplib: host name too long for SOCKS5: %s", host)
+        }
+        req = append(req, 3, byte(len(host)))
+        req = append(req, host...)
+    } else if ip4 := ip.To4(); ip4 != nil {
+        req = append(req, 1)
+        req = append(req, ip4...)
+    } else {
+        req = append(req, 4)
+        req = append(req, ip...)
+    }
+    req = append(req, byte(port>>8), byte(port))
+    if _, err := conn.Write(req); err != nil {
+        return err
+    }
+
+    // version, status, reserved and the type of the bound address
+    header := make([]byte, 4)
+    if _, err := io.ReadFull(conn, header); err != nil {
+        return err
+    }
+    if header[1] != 0 {
+        msg := "unknown error"
+        if int(header[1]) < len(socks5Errors) {
+            msg = socks5Errors[header[1]]
+        }
+        return fmt.Errorf("httplib: SOCKS5 proxy failed to connect to %s: %s", addr, msg)
+    }
+    var skip int
+    switch header[3] {
+    case 1:
+        skip = net.IPv4len
+    case 4:
+        skip = net.IPv6len
+    case 3:
+        n := make([]byte, 1)
+        if _, err := io.ReadFull(conn, n); err != nil {
+            return err
+        }
+        skip = int(n[0])
+    default:
+        return fmt.Errorf("httplib: unexpected SOCKS5 address type %d", header[3])
+    }
+    // the bound address and port aren't needed
+    _, err = io.ReadFull(conn, make([]byte, skip+2))
+    return err
+}
@@ -0,0 +1,233 @@
+package httplib
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestNoProxy(t *testing.T) {
+    list := "*.internal, example.com, .corp.test, 10.0.0.0/8, 192.168.1.5, api.test:8080"
+    for _, c := range []struct {
+        host, port string
+        want       bool
+    }{
+        {"svc.internal", "80", true},
+        {"a.b.internal", "80", true},
+        {"internal.com", "80", false},
+        {"example.com", "443", true},
+        {"www.example.com", "80", true},
+        {"notexample.com", "80", false},
+        {"corp.test", "80", true},
+        {"x.corp.test", "80", true},
+        {"10.1.2.3", "80", true},
+        {"11.1.2.3", "80", false},
+        {"192.168.1.5", "80", true},
+        {"192.168.1.6", "80", false},
+        {"api.test", "8080", true},
+        {"api.test", "80", false},
+        {"localhost", "80", true},
+        {"127.0.0.1", "80", true},
+        {"Example.COM", "80", true},
+    } {
+        if got := noProxy(c.host, c.port, list); got != c.want {
+            t.Errorf("noProxy(%q, %q) = %v, expected %v", c.host, c.port, got, c.want)
+        }
+    }
+    if !noProxy("anything.test", "80", "*") {
+        t.Errorf("expected * to exempt every host")
+    }
+    if noProxy("anything.test", "80", "") {
+        t.Errorf("expected an empty list to exempt no host")
+    }
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("proxy " + r.RequestURI + " " + r.Header.Get("Proxy-Authorization")))
+    }))
+    defer proxy.Close()
+    direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("direct " + r.RequestURI))
+    }))
+    defer direct.Close()
+
+    t.Setenv("http_proxy", "http://user:pass@"+proxy.Listener.Addr().String())
+    t.Setenv("no_proxy", "*.internal,direct.test")
+    s, err := Get("http://app.test/a%20b?q=1").ProxyFromEnvironment().AsString()
+    if err != nil || s != "proxy http://app.test/a%20b?q=1 Basic dXNlcjpwYXNz" {
+        t.Fatalf("unexpected proxied response %q, %v", s, err)
+    }
+    for _, host := range []string{"svc.internal", "direct.test"} {
+        s, err := Get("http://"+host+"/x").ResolveOverride(host, direct.Listener.Addr().String()).ProxyFromEnvironment().AsString()
+        if err != nil || s != "direct /x" {
+            t.Fatalf("%s: expected to bypass the proxy, got %q, %v", host, s, err)
+        }
+    }
+    if s, _ := Get(direct.URL + "/local").ProxyFromEnvironment().AsString(); s != "direct /local" {
+        t.Fatalf("expected loopback addresses to bypass the proxy, got %q", s)
+    }
+    _, err = Get("http://app.test/x").ResolveOverride("app.test", "10.1.2.3:8080").ProxyFromEnvironment().AsString()
+    if err == nil || !strings.Contains(err.Error(), "through the http proxy") {
+        t.Fatalf("expected ResolveOverride through the proxy to fail, got %v", err)
+    }
+    s, err = Get("http://app.test/x").ResolveOverride("app.test", direct.Listener.Addr().String()).AsString()
+    if err != nil || s != "direct /x" {
+        t.Fatalf("expected the environment to be ignored by default, got %q, %v", s, err)
+    }
+}
+
+func TestProxyFromEnvironmentCGI(t *testing.T) {
+    target := &url.URL{Scheme: "http", Host: "app.test"}
+    t.Setenv("HTTP_PROXY", "http://attacker.test:8080")
+    t.Setenv("REQUEST_METHOD", "GET")
+    if proxy, err := proxyFromEnvironment(target); proxy != nil || err != nil {
+        t.Fatalf("expected HTTP_PROXY to be ignored under CGI, got %v, %v", proxy, err)
+    }
+    t.Setenv("http_proxy", "http://proxy.test:8080")
+    if proxy, _ := proxyFromEnvironment(target); proxy == nil || proxy.Host != "proxy.test:8080" {
+        t.Fatalf("expected http_proxy to be used under CGI, got %v", proxy)
+    }
+}
+
+func TestProxyConnect(t *testing.T) {
+    // the test certificate is valid for example.com
+    ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("secure " + r.Host))
+    }))
+    defer ts.Close()
+    var tunnelled string
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "CONNECT" {
+            http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+            return
+        }
+        tunnelled = r.Host
+        upstream, err := net.Dial("tcp", ts.Listener.Addr().String())
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadGateway)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        conn, buf, _ := w.(http.Hijacker).Hijack()
+        go func() {
+            io.Copy(upstream, buf)
+            upstream.Close()
+        }()
+        io.Copy(conn, upstream)
+        conn.Close()
+    }))
+    defer proxy.Close()
+
+    t.Setenv("https_proxy", proxy.URL)
+    s, err := Get("https://example.com/").TLSConfig(trustServer(ts)).ProxyFromEnvironment().AsString()
+    if err != nil || s != "secure example.com" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if tunnelled != "example.com:443" {
+        t.Fatalf("expected a tunnel to example.com:443, got %q", tunnelled)
+    }
+}
+
+// socks5Server is a minimal SOCKS5 proxy that requires the given username
+// and password if user isn't empty, and connects every CONNECT to upstream.
+func socks5Server(t *testing.T, user, pass, upstream string) (addr string, targets chan string) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+    targets = make(chan string, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                buf := make([]byte, 512)
+                io.ReadFull(conn, buf[:2])
+                methods := buf[2 : 2+buf[1]]
+                io.ReadFull(conn, methods)
+                if user == "" {
+                    conn.Write([]byte{5, 0})
+                } else {
+                    if bytes.IndexByte(methods, 2) == -1 {
+                        conn.Write([]byte{5, 0xff})
+                        return
+                    }
+                    conn.Write([]byte{5, 2})
+                    io.ReadFull(conn, buf[:2])
+                    u := make([]byte, buf[1])
+                    io.ReadFull(conn, u)
+                    io.ReadFull(conn, buf[:1])
+                    p := make([]byte, buf[0])
+                    io.ReadFull(conn, p)
+                    if string(u) != user || string(p) != pass {
+                        conn.Write([]byte{1, 1})
+                        return
+                    }
+                    conn.Write([]byte{1, 0})
+                }
+                io.ReadFull(conn, buf[:5])
+                host := make([]byte, buf[4])
+                io.ReadFull(conn, host)
+                io.ReadFull(conn, buf[:2])
+                targets <- net.JoinHostPort(string(host), strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+                up, err := net.Dial("tcp", upstream)
+                if err != nil {
+                    conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+                    return
+                }
+                defer up.Close()
+                conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+                go io.Copy(up, conn)
+                io.Copy(conn, up)
+            }()
+        }
+    }()
+    return l.Addr().String(), targets
+}
+
+func TestSocks5Proxy(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("via socks " + r.Host))
+    }))
+    defer ts.Close()
+    // the test certificate is valid for example.com
+    tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("secure via socks " + r.Host))
+    }))
+    defer tlsServer.Close()
+
+    addr, targets := socks5Server(t, "", "", ts.Listener.Addr().String())
+    s, err := Get("http://app.test/").Socks5Proxy(addr, "", "").AsString()
+    if err != nil || s != "via socks app.test" {
+        t.Fatalf("unexpected response %q, %v", s, err)
+    }
+    if target := <-targets; target != "app.test:80" {
+        t.Fatalf("expected a CONNECT to app.test:80, got %q", target)
+    }
+
+    addr, targets = socks5Server(t, "user", "secret", tlsServer.Listener.Addr().String())
+    s, err = Get("https://example.com/").Socks5Proxy(addr, "user", "secret").TLSConfig(trustServer(tlsServer)).AsString()
+    if err != nil || s != "secure via socks example.com" {
+        t.Fatalf("unexpected TLS response %q, %v", s, err)
+    }
+    if target := <-targets; target != "example.com:443" {
+        t.Fatalf("expected a CONNECT to example.com:443, got %q", target)
+    }
+    if _, err := Get("https://example.com/").Socks5Proxy(addr, "user", "wrong").AsString(); err == nil {
+        t.Fatalf("expected wrong credentials to fail")
+    }
+    if _, err := Get("https://example.com/").Socks5Proxy(addr, "", "").AsString(); err == nil {
+        t.Fatalf("expected missing credentials to fail")
+    }
+}
@@ -0,0 +1,101 @@
+package httplib
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "syscall"
+    "time"
+)
+
+// ErrSessionClosed is returned by a KeepAliveSession once its connection
+// has been closed, by the server or by Close.
+var ErrSessionClosed = errors.New("httplib: keep-alive session closed")
+
+// KeepAliveSession sends requests one at a time over a single connection
+// that it keeps open between them, for protocols that need ordered requests
+// on the same socket, or to test how a server handles keep-alive. Unlike a
+// Client it never opens a second connection: once the server closes the one
+// it has, requests fail with ErrSessionClosed.
+//
+// The zero value is ready to use. A KeepAliveSession is not safe for
+// concurrent use, and must be closed when done with.
+type KeepAliveSession struct {
+    conn   *persistConn
+    key    string
+    closed bool
+}
+
+// Do sends the request built by b on the connection of the session and
+// returns the response, dialing the connection with the settings of b for
+// the first request. Later requests must be for the same host with the same
+// connection settings. Each request is sent once, without retries or
+// following redirects, and only the returned response is of use: As*
+// methods of b would send it again.
+//
+// The body of a response must be read, or closed to skip it, before the
+// next request, which otherwise discards it. With RawChunks, closing a body
+// before its end closes the connection instead. When the server closes the
+// connection after a response, with Connection: close, the response is
+// returned as usual, and the requests after it fail with ErrSessionClosed,
+// as they do when the server closes the connection between requests.
+func (s *KeepAliveSession) Do(b *HttpRequestBuilder) (*http.Response, error) {
+    if s.closed || s.conn != nil && s.conn.broken {
+        // the server closed the connection, or a body was closed unread
+        s.Close()
+        return nil, ErrSessionClosed
+    }
+    u, err := b.newRequest()
+    if err != nil {
+        return nil, err
+    }
+    key := b.poolKey(u)
+    if key == "" {
+        return nil, errors.New("httplib: a keep-alive session needs HTTP/1.1 requests")
+    }
+    if b.timeout > 0 {
+        b.deadline = time.Now().Add(b.timeout)
+    }
+    opts := b.connOptions()
+    if s.conn == nil {
+        conn, err := dial(u, b.req, opts)
+        if err != nil {
+            return nil, err
+        }
+        s.conn, s.key = conn, key
+    } else if key != s.key {
+        return nil, errors.New("httplib: requests in a keep-alive session must share a host and connection settings")
+    } else {
+        s.conn.setOptions(opts)
+    }
+
+    resp, err := s.conn.roundTrip(b.req)
+    if b.req.Body != nil {
+        b.req.Body.Close()
+    }
+    if err != nil {
+        s.Close()
+        if err == io.EOF || err == io.ErrUnexpectedEOF ||
+            errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+            // the server closed the connection rather than answer
+            return nil, ErrSessionClosed
+        }
+        return nil, err
+    }
+    // a connection the server is closing stays open until the body is read
+    s.closed = s.conn.broken
+    b.resp = resp
+    b.wrapBody(resp)
+    return resp, nil
+}
+
+// Close closes the connection of the session.
+func (s *KeepAliveSession) Close() error {
+    s.closed = true
+    if s.conn == nil {
+        return nil
+    }
+    err := s.conn.Close()
+    s.conn = nil
+    return err
+}
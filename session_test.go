@@ -0,0 +1,96 @@
+package httplib
+
+import (
+    "bufio"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestKeepAliveSession(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/close" {
+            w.Header().Set("Connection", "close")
+        }
+        w.Write([]byte(r.RemoteAddr))
+    }))
+    defer ts.Close()
+
+    var s KeepAliveSession
+    defer s.Close()
+    var addrs []string
+    for _, path := range []string{"/1", "/2", "/close"} {
+        resp, err := s.Do(Get(ts.URL + path))
+        if err != nil {
+            t.Fatalf("%s: request failed: %s", path, err.Error())
+        }
+        body, _ := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        addrs = append(addrs, string(body))
+    }
+    if addrs[0] != addrs[1] || addrs[1] != addrs[2] {
+        t.Fatalf("expected every request on one connection, got %q", addrs)
+    }
+    if _, err := s.Do(Get(ts.URL + "/after")); err != ErrSessionClosed {
+        t.Fatalf("expected ErrSessionClosed after the server closed the connection, got %v", err)
+    }
+
+    var s2 KeepAliveSession
+    defer s2.Close()
+    if _, err := s2.Do(Get(ts.URL)); err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    if _, err := s2.Do(Get("http://example.com/")); err == nil {
+        t.Fatalf("expected an error for a request to another host")
+    }
+    ts.CloseClientConnections()
+    if _, err := s2.Do(Get(ts.URL)); err != ErrSessionClosed {
+        t.Fatalf("expected ErrSessionClosed once the server dropped the connection, got %v", err)
+    }
+}
+
+func TestKeepAliveSessionRawChunks(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go func() {
+        conn, err := l.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        r := bufio.NewReader(conn)
+        for {
+            if _, err := http.ReadRequest(r); err != nil {
+                return
+            }
+            io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+        }
+    }()
+    url := "http://" + l.Addr().String()
+
+    var s KeepAliveSession
+    defer s.Close()
+    resp, err := s.Do(Get(url).RawChunks())
+    if err != nil {
+        t.Fatalf("request failed: %s", err.Error())
+    }
+    if body, _ := ioutil.ReadAll(resp.Body); string(body) != "hello world" {
+        t.Fatalf("unexpected body %q", body)
+    }
+    resp.Body.Close()
+    resp, err = s.Do(Get(url).RawChunks())
+    if err != nil {
+        t.Fatalf("expected the connection to be reused after reading the body, got %v", err)
+    }
+    resp.Body.Read(make([]byte, 3))
+    resp.Body.Close()
+    if _, err := s.Do(Get(url).RawChunks()); err != ErrSessionClosed {
+        t.Fatalf("expected ErrSessionClosed after closing a body early, got %v", err)
+    }
+}
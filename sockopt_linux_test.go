@@ -0,0 +1,68 @@
+package httplib
+
+import (
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "syscall"
+    "testing"
+)
+
+// tcpRecorder dials TCP connections, keeping them to inspect.
+type tcpRecorder struct {
+    conns []*net.TCPConn
+}
+
+func (d *tcpRecorder) Dial(network, addr string) (net.Conn, error) {
+    conn, err := net.Dial(network, addr)
+    if err != nil {
+        return nil, err
+    }
+    d.conns = append(d.conns, conn.(*net.TCPConn))
+    return conn, nil
+}
+
+func noDelay(t *testing.T, conn *net.TCPConn) bool {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var v int
+    raw.Control(func(fd uintptr) {
+        v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return v != 0
+}
+
+func TestTCPNoDelay(t *testing.T) {
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    })
+    ts := httptest.NewServer(handler)
+    defer ts.Close()
+    tlsServer := httptest.NewTLSServer(handler)
+    defer tlsServer.Close()
+
+    for _, c := range []struct {
+        b    *HttpRequestBuilder
+        want bool
+    }{
+        {Get(ts.URL), true},
+        {Get(ts.URL).TCPNoDelay(false), false},
+        {Get(tlsServer.URL).TLSConfig(trustServer(tlsServer)), true},
+        {Get(tlsServer.URL).TLSConfig(trustServer(tlsServer)).TCPNoDelay(false), false},
+    } {
+        d := &tcpRecorder{}
+        resp, err := c.b.Dialer(d).AsResponse()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := noDelay(t, d.conns[0]); got != c.want {
+            t.Errorf("%s: expected TCP_NODELAY %v, got %v", c.b.url, c.want, got)
+        }
+        resp.Body.Close()
+    }
+}